@@ -0,0 +1,359 @@
+// Package admin contains HTTP handlers for inspecting and managing a running Yukari instance.
+//
+// These handlers are meant to be served on a separate listener that is not exposed to clients.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/gc"
+	"github.com/tigrisdata-community/yukari/internal/modelref"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+	"github.com/tigrisdata-community/yukari/internal/warm"
+)
+
+// progressInterval is how often download progress is sent to event stream clients.
+const progressInterval = time.Second
+
+type Server struct {
+	d    *download.Downloader
+	s    store.Store
+	pins *pin.Set
+	gc   *gc.Collector
+	sw   *gc.Sweeper
+	warm *warm.Warmer
+}
+
+// New creates a Server. collector is nil if garbage collection is disabled, and warmer is nil while
+// offline.
+func New(d *download.Downloader, s store.Store, pins *pin.Set, collector *gc.Collector, sweeper *gc.Sweeper, warmer *warm.Warmer) *Server {
+	return &Server{d: d, s: s, pins: pins, gc: collector, sw: sweeper, warm: warmer}
+}
+
+// Register adds the admin routes to mux.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/dead-letters", s.listDeadLetters)
+	mux.HandleFunc("POST /admin/dead-letters/{id}/retry", s.retryDeadLetter)
+	mux.HandleFunc("DELETE /admin/dead-letters/{id}", s.deleteDeadLetter)
+	mux.HandleFunc("GET /admin/downloads", s.listDownloads)
+	mux.HandleFunc("GET /admin/downloads/events", s.downloadEvents)
+	mux.HandleFunc("GET /admin/gc", s.lastCollection)
+	mux.HandleFunc("POST /admin/gc", s.collect)
+	mux.HandleFunc("GET /admin/pins", s.listPins)
+	mux.HandleFunc("PUT /admin/pins/{ref...}", s.addPin)
+	mux.HandleFunc("DELETE /admin/pins/{ref...}", s.removePin)
+	mux.HandleFunc("GET /admin/sweep", s.lastSweep)
+	mux.HandleFunc("POST /admin/sweep", s.sweep)
+	mux.HandleFunc("GET /admin/tags/{ref...}", s.tagHistory)
+	mux.HandleFunc("GET /admin/warm", s.warmStatus)
+	mux.HandleFunc("POST /admin/warm", s.startWarm)
+}
+
+func (s *Server) listDownloads(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.d.Downloads(r.Context())
+	if err != nil {
+		slog.Error("can't list downloads", "err", err)
+		http.Error(w, "can't list downloads", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// downloadEvents sends the status of every queued and running download as a server-sent event
+// every progressInterval until the client goes away.
+func (s *Server) downloadEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+
+	for {
+		data, err := json.Marshal(s.d.Active())
+		if err != nil {
+			slog.Error("can't encode download progress", "err", err)
+			return
+		}
+
+		if _, err := fmt.Fprintf(w, "event: downloads\ndata: %s\n\n", data); err != nil {
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			slog.Debug("can't flush event stream", "err", err)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Server) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.d.DeadLetters(r.Context())
+	if err != nil {
+		slog.Error("can't list dead letters", "err", err)
+		http.Error(w, "can't list dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) retryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if err := s.d.RetryDeadLetter(r.Context(), id); err != nil {
+		jobError(w, "retry", id, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) deleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if err := s.d.DeleteDeadLetter(r.Context(), id); err != nil {
+		jobError(w, "delete", id, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tagHistory shows which manifests a tag (such as `library/llama3:latest`) has pointed at, so that
+// an older one can be pulled by digest.
+func (s *Server) tagHistory(w http.ResponseWriter, r *http.Request) {
+	ref := r.PathValue("ref")
+
+	t, err := download.LoadTag(r.Context(), s.s, pin.TagKey(pin.SplitRef(ref)))
+	switch {
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, download.ErrNotTag):
+		http.Error(w, "no history for tag", http.StatusNotFound)
+		return
+	case err != nil:
+		slog.Error("can't load tag", "ref", ref, "err", err)
+		http.Error(w, "can't load tag", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (s *Server) lastCollection(w http.ResponseWriter, r *http.Request) {
+	if s.gc == nil {
+		http.Error(w, "garbage collection is disabled", http.StatusNotFound)
+		return
+	}
+
+	report := s.gc.LastReport()
+	if report == nil {
+		http.Error(w, "garbage collection hasn't run yet", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// collect runs garbage collection now. With `?dry-run=true`, it reports what would be evicted
+// without deleting anything.
+func (s *Server) collect(w http.ResponseWriter, r *http.Request) {
+	if s.gc == nil {
+		http.Error(w, "garbage collection is disabled", http.StatusNotFound)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry-run") == "true"
+
+	report, err := s.gc.Collect(r.Context(), dryRun)
+	if err != nil {
+		slog.Error("can't collect garbage", "err", err)
+		http.Error(w, "can't collect garbage", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) lastSweep(w http.ResponseWriter, r *http.Request) {
+	report := s.sw.LastReport()
+	if report == nil {
+		http.Error(w, "no sweep has run yet", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// sweep looks for orphaned blobs now. Orphans are only reported unless `?delete=true` is given.
+func (s *Server) sweep(w http.ResponseWriter, r *http.Request) {
+	del := r.URL.Query().Get("delete") == "true"
+
+	report, err := s.sw.Sweep(r.Context(), !del)
+	if err != nil {
+		slog.Error("can't sweep orphaned blobs", "err", err)
+		http.Error(w, "can't sweep orphaned blobs", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) listPins(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.pins.List())
+}
+
+// addPin pins a tag (such as `library/llama3:latest@sha256:...`). If no digest is given, the tag is
+// pinned to the manifest it points at in the cache right now.
+func (s *Server) addPin(w http.ResponseWriter, r *http.Request) {
+	ref := r.PathValue("ref")
+
+	if !strings.Contains(ref, "@") {
+		digest, err := s.currentDigest(r, ref)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			http.Error(w, "tag isn't cached, give a digest to pin it to", http.StatusNotFound)
+			return
+		case err != nil:
+			slog.Error("can't find digest for tag", "ref", ref, "err", err)
+			http.Error(w, "can't find digest for tag", http.StatusInternalServerError)
+			return
+		}
+
+		ref += "@" + digest
+	}
+
+	p, err := pin.Parse(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.pins.Add(r.Context(), p); err != nil {
+		pinError(w, "add", p.String(), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+// currentDigest returns the digest of the manifest a cached tag points at.
+func (s *Server) currentDigest(r *http.Request, ref string) (string, error) {
+	info, err := s.s.Stat(r.Context(), pin.TagKey(pin.SplitRef(ref)))
+	if err != nil {
+		return "", err
+	}
+
+	if digest := info.Metadata[download.MetadataDigest]; digest != "" {
+		return digest, nil
+	}
+
+	_, _, digest, err := download.ReadManifest(r.Context(), s.s, info.Key)
+	return digest, err
+}
+
+func (s *Server) removePin(w http.ResponseWriter, r *http.Request) {
+	ref := r.PathValue("ref")
+	name, tag := pin.SplitRef(ref)
+
+	if err := s.pins.Remove(r.Context(), name, tag); err != nil {
+		pinError(w, "remove", ref, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func pinError(w http.ResponseWriter, verb, ref string, err error) {
+	switch {
+	case errors.Is(err, pin.ErrNotPinned):
+		http.Error(w, "tag isn't pinned", http.StatusNotFound)
+	case errors.Is(err, pin.ErrFromFile):
+		http.Error(w, "tag is pinned in the pin file, change it there", http.StatusConflict)
+	default:
+		slog.Error("can't "+verb+" pin", "ref", ref, "err", err)
+		http.Error(w, "can't "+verb+" pin", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) warmStatus(w http.ResponseWriter, r *http.Request) {
+	if s.warm == nil {
+		http.Error(w, "warming is disabled while offline", http.StatusNotFound)
+		return
+	}
+
+	report := s.warm.Status()
+	if report == nil {
+		http.Error(w, "nothing has been warmed yet", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// startWarm starts caching the models in the request body, a JSON array of references such as
+// `["library/llama3:8b", "urn:air:sd1:model:civitai:2421@43533"]`. Progress is at GET /admin/warm.
+func (s *Server) startWarm(w http.ResponseWriter, r *http.Request) {
+	if s.warm == nil {
+		http.Error(w, "warming is disabled while offline", http.StatusNotFound)
+		return
+	}
+
+	var refs []string
+	if err := json.NewDecoder(r.Body).Decode(&refs); err != nil {
+		http.Error(w, "can't parse request body, want a JSON array of models", http.StatusBadRequest)
+		return
+	}
+
+	targets, err := modelref.ParseAll(refs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Warming outlives this request, so it doesn't use the request's context.
+	if _, err := s.warm.Start(context.Background(), targets); err != nil {
+		http.Error(w, "already warming models", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func jobError(w http.ResponseWriter, verb, id string, err error) {
+	if errors.Is(err, download.ErrJobNotFound) {
+		http.Error(w, "no such dead letter", http.StatusNotFound)
+		return
+	}
+
+	slog.Error("can't "+verb+" dead letter", "id", id, "err", err)
+	http.Error(w, "can't "+verb+" dead letter", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(data); err != nil {
+		slog.Debug("can't write JSON response", "err", err)
+	}
+}
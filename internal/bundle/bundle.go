@@ -0,0 +1,62 @@
+// Package bundle moves cached models between Yukari instances that can't reach each other, such as
+// into an air-gapped site.
+//
+// A bundle is a tar archive in the OCI image layout: an `oci-layout` file, an `index.json` listing
+// the models in it, and every manifest, config, layer, and Civitai file under `blobs/sha256/`. Tools
+// like `oras` and `skopeo` can read the Ollama models in it. Civitai models are listed in the index
+// with their metadata as the blob, and their files are the blobs with the hashes in that metadata.
+//
+// `index.json` is always written before any blobs, so that bundles can be imported in one pass.
+package bundle
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// AnnotationRef is the model a manifest in the index is for, such as `library/llama3:8b`.
+	AnnotationRef = "io.yukari.ref"
+
+	// AnnotationCivitaiModel is the ID of the Civitai model an index entry is the metadata of.
+	AnnotationCivitaiModel = "io.yukari.civitai.model"
+
+	// annotationRefName is the standard OCI annotation for a manifest's tag.
+	annotationRefName = "org.opencontainers.image.ref.name"
+
+	indexMediaType = "application/vnd.oci.image.index.v1+json"
+	layoutVersion  = "1.0.0"
+)
+
+var blobNameRegex = regexp.MustCompile(`^blobs/sha256/([0-9a-f]{64})$`)
+
+// Layout is the `oci-layout` file.
+type Layout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// Index is the `index.json` file.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Descriptor is an entry in the index.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// blobName returns the name of a blob in the archive.
+func blobName(digest string) (string, error) {
+	name := "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+	if !strings.HasPrefix(digest, "sha256:") || !blobNameRegex.MatchString(name) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+
+	return name, nil
+}
@@ -0,0 +1,195 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tigrisdata-community/yukari/civitai"
+	"github.com/tigrisdata-community/yukari/internal/civitaiproxy"
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/modelref"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+func put(t *testing.T, s store.Store, key, contentType, data string) {
+	t.Helper()
+
+	if err := s.Put(context.Background(), key, strings.NewReader(data), int64(len(data)), store.PutOptions{
+		ContentType: contentType,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seed caches an Ollama model and a Civitai model in s.
+func seed(t *testing.T, s store.Store) (layer, file string) {
+	ctx := context.Background()
+
+	layer = "i am a model layer"
+	layerDigest := download.Digest([]byte(layer))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"layers":[{"digest":%q,"size":%d}]}`, download.ManifestMediaType, layerDigest, len(layer))
+	manifestDigest := download.Digest([]byte(manifest))
+
+	put(t, s, download.BlobKey(layerDigest), "application/octet-stream", layer)
+	put(t, s, download.ManifestKey(manifestDigest), download.ManifestMediaType, manifest)
+	if err := download.PutTag(ctx, s, pin.TagKey("library/llama3", "8b"), manifestDigest, download.ManifestMediaType, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	file = "i am a checkpoint"
+	fileDigest := download.Digest([]byte(file))
+	put(t, s, download.BlobKey(fileDigest), "application/octet-stream", file)
+
+	if err := civitaiproxy.PutModelMetadata(ctx, s, &civitai.ModelResponse{
+		ID:   2421,
+		Name: "test",
+		ModelVersions: []civitai.ModelVersions{{
+			ID:      43533,
+			ModelID: 2421,
+			Files: []civitai.Files{{
+				Name:   "model.safetensors",
+				Hashes: civitai.Hashes{Sha256: strings.ToUpper(strings.TrimPrefix(fileDigest, "sha256:"))},
+			}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return layer, file
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	src := store.NewMemory()
+	layer, file := seed(t, src)
+
+	refs, err := modelref.ParseAll([]string{"library/llama3:8b", "43533"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Export(ctx, src, &buf, refs); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := store.NewMemory()
+	r, err := Import(ctx, dst, nil, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Models) != 2 || r.Blobs != 4 || r.Skipped != 0 {
+		t.Fatalf("wrong import report: %+v", r)
+	}
+
+	m, err := download.LoadManifest(ctx, dst, pin.TagKey("library/llama3", "8b"))
+	if err != nil {
+		t.Fatalf("tag wasn't imported: %v", err)
+	}
+	if cached, err := download.FullyCached(ctx, dst, *m); err != nil || !cached {
+		t.Fatalf("model wasn't fully imported: %v", err)
+	}
+
+	for _, data := range []string{layer, file} {
+		if _, err := dst.Stat(ctx, download.BlobKey(download.Digest([]byte(data)))); err != nil {
+			t.Fatalf("blob wasn't imported: %v", err)
+		}
+	}
+
+	if _, err := dst.Stat(ctx, "civitai/models/2421"); err != nil {
+		t.Fatalf("civitai metadata wasn't imported: %v", err)
+	}
+
+	// Importing again skips the blobs that are already there.
+	r, err = Import(ctx, dst, nil, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Skipped != 2 {
+		t.Fatalf("wanted 2 blobs skipped, got %+v", r)
+	}
+}
+
+func TestExportUncached(t *testing.T) {
+	refs, err := modelref.ParseAll([]string{"library/llama3:70b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := store.NewMemory()
+	seed(t, s)
+
+	if err := Export(context.Background(), s, io.Discard, refs); err == nil {
+		t.Fatal("exported a model that isn't cached")
+	}
+}
+
+func TestImportTampered(t *testing.T) {
+	ctx := context.Background()
+
+	src := store.NewMemory()
+	layer, _ := seed(t, src)
+
+	refs, err := modelref.ParseAll([]string{"library/llama3:8b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Export(ctx, src, &buf, refs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the layer for something else of the same size.
+	var tampered bytes.Buffer
+	tr := tar.NewReader(&buf)
+	tw := tar.NewWriter(&tampered)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) == layer {
+			data = bytes.ToUpper(data)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := store.NewMemory()
+	if _, err := Import(ctx, dst, nil, &tampered); !errors.Is(err, download.ErrChecksumMismatch) {
+		t.Fatalf("wanted a checksum mismatch, got %v", err)
+	}
+
+	if _, err := dst.Stat(ctx, download.BlobKey(download.Digest([]byte(layer)))); err == nil {
+		t.Fatal("tampered blob was kept")
+	}
+	if _, err := dst.Stat(ctx, pin.TagKey("library/llama3", "8b")); err == nil {
+		t.Fatal("tag was pointed at a model with a tampered blob")
+	}
+}
@@ -0,0 +1,308 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/civitai"
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/modelref"
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// exporter collects what goes into a bundle.
+type exporter struct {
+	s     store.Store
+	index Index
+	blobs []string          // keys, in the order they are written
+	seen  map[string]bool   // keys already in blobs
+	small map[string][]byte // manifests and metadata, by digest
+}
+
+// Export writes the models in refs to w as a bundle. Every Ollama model has to be fully cached, and
+// every Civitai model version has to have at least one file cached.
+func Export(ctx context.Context, s store.Store, w io.Writer, refs []modelref.Ref) error {
+	e := &exporter{
+		s: s,
+		index: Index{
+			SchemaVersion: 2,
+			MediaType:     indexMediaType,
+			Manifests:     []Descriptor{},
+		},
+		seen:  map[string]bool{},
+		small: map[string][]byte{},
+	}
+
+	for _, ref := range refs {
+		var err error
+		if ref.IsCivitai() {
+			err = e.addCivitai(ctx, ref)
+		} else {
+			err = e.addOllama(ctx, ref)
+		}
+		if err != nil {
+			return fmt.Errorf("can't export %s: %w", ref, err)
+		}
+	}
+
+	return e.write(ctx, w)
+}
+
+func (e *exporter) addOllama(ctx context.Context, ref modelref.Ref) error {
+	obj, err := download.OpenManifest(ctx, e.s, ref.Key())
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return errors.New("model isn't cached")
+		}
+		return err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return fmt.Errorf("can't read manifest: %w", err)
+	}
+
+	var m download.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("can't parse manifest: %w", err)
+	}
+
+	cached, err := download.FullyCached(ctx, e.s, m)
+	if err != nil {
+		return err
+	}
+	if !cached {
+		return errors.New("model isn't fully cached, warm it first")
+	}
+
+	mediaType := obj.ContentType
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	if mediaType == "" {
+		mediaType = download.ManifestMediaType
+	}
+
+	digest := download.Digest(data)
+	e.small[digest] = data
+	e.index.Manifests = append(e.index.Manifests, Descriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      int64(len(data)),
+		Annotations: map[string]string{
+			AnnotationRef:     ref.Name + ":" + ref.Tag,
+			annotationRefName: ref.Tag,
+		},
+	})
+
+	for _, blob := range m.Blobs() {
+		e.addBlob(download.BlobKey(blob.Digest))
+	}
+
+	return nil
+}
+
+func (e *exporter) addCivitai(ctx context.Context, ref modelref.Ref) error {
+	modelID, err := e.civitaiModelID(ctx, ref.ModelVersion)
+	if err != nil {
+		return err
+	}
+
+	obj, err := e.s.Get(ctx, "civitai/models/"+modelID, store.Range{})
+	if err != nil {
+		return fmt.Errorf("can't get model metadata: %w", err)
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return fmt.Errorf("can't read model metadata: %w", err)
+	}
+
+	var model civitai.ModelResponse
+	if err := json.Unmarshal(data, &model); err != nil {
+		return fmt.Errorf("can't parse model metadata: %w", err)
+	}
+
+	var found int
+	for _, version := range model.ModelVersions {
+		if strconv.Itoa(version.ID) != ref.ModelVersion {
+			continue
+		}
+
+		for _, file := range version.Files {
+			key := download.BlobKey("sha256:" + strings.ToLower(file.Hashes.Sha256))
+			if _, err := e.s.Stat(ctx, key); err != nil {
+				continue
+			}
+
+			e.addBlob(key)
+			found++
+		}
+	}
+
+	if found == 0 {
+		return errors.New("none of the model version's files are cached, warm it first")
+	}
+
+	digest := download.Digest(data)
+	if _, ok := e.small[digest]; ok {
+		return nil
+	}
+
+	e.small[digest] = data
+	e.index.Manifests = append(e.index.Manifests, Descriptor{
+		MediaType: download.CivitaiModelMediaType,
+		Digest:    digest,
+		Size:      int64(len(data)),
+		Annotations: map[string]string{
+			AnnotationCivitaiModel: modelID,
+		},
+	})
+
+	return nil
+}
+
+// civitaiModelID finds the model a model version belongs to.
+func (e *exporter) civitaiModelID(ctx context.Context, modelVersion string) (string, error) {
+	// The proxy caches model version metadata, but models that were warmed only have model metadata.
+	if obj, err := e.s.Get(ctx, "civitai/model-versions/"+modelVersion, store.Range{}); err == nil {
+		defer obj.Body.Close()
+
+		var mv civitai.ModelVersionResponse
+		if err := json.NewDecoder(obj.Body).Decode(&mv); err != nil {
+			return "", fmt.Errorf("can't parse model version metadata: %w", err)
+		}
+
+		return strconv.Itoa(mv.ModelID), nil
+	}
+
+	models, err := e.s.List(ctx, store.Query{Prefix: "civitai/models/"})
+	if err != nil {
+		return "", fmt.Errorf("can't list civitai models: %w", err)
+	}
+
+	for _, info := range models {
+		obj, err := e.s.Get(ctx, info.Key, store.Range{})
+		if err != nil {
+			return "", err
+		}
+
+		var model civitai.ModelResponse
+		err = json.NewDecoder(obj.Body).Decode(&model)
+		obj.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("can't parse %s: %w", info.Key, err)
+		}
+
+		for _, version := range model.ModelVersions {
+			if strconv.Itoa(version.ID) == modelVersion {
+				return strconv.Itoa(model.ID), nil
+			}
+		}
+	}
+
+	return "", errors.New("model version isn't cached")
+}
+
+func (e *exporter) addBlob(key string) {
+	if e.seen[key] {
+		return
+	}
+
+	e.seen[key] = true
+	e.blobs = append(e.blobs, key)
+}
+
+func (e *exporter) write(ctx context.Context, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	layout, err := json.Marshal(Layout{ImageLayoutVersion: layoutVersion})
+	if err != nil {
+		return err
+	}
+
+	index, err := json.Marshal(e.index)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"oci-layout", layout},
+		{"index.json", index},
+	} {
+		if err := writeFile(tw, f.name, int64(len(f.data)), now, bytes.NewReader(f.data)); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range e.index.Manifests {
+		name, err := blobName(d.Digest)
+		if err != nil {
+			return err
+		}
+
+		data := e.small[d.Digest]
+		if err := writeFile(tw, name, int64(len(data)), now, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range e.blobs {
+		if err := e.writeBlob(ctx, tw, key); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("can't finish bundle: %w", err)
+	}
+
+	return nil
+}
+
+func (e *exporter) writeBlob(ctx context.Context, tw *tar.Writer, key string) error {
+	name, err := blobName(strings.TrimPrefix(key, "blobs/"))
+	if err != nil {
+		return err
+	}
+
+	obj, err := e.s.Get(ctx, key, store.Range{})
+	if err != nil {
+		return fmt.Errorf("can't get %s: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	return writeFile(tw, name, obj.Size, obj.LastModified, obj.Body)
+}
+
+func writeFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  modTime,
+	}); err != nil {
+		return fmt.Errorf("can't write header for %s: %w", name, err)
+	}
+
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("can't write %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// maxIndexedBlobSize is the biggest manifest or Civitai metadata that is read into memory on import.
+const maxIndexedBlobSize = 16 << 20
+
+// ImportReport is what an import stored.
+type ImportReport struct {
+	Models  []string `json:"models"`
+	Blobs   int      `json:"blobs"`   // stored
+	Skipped int      `json:"skipped"` // already in the store
+	Bytes   int64    `json:"bytes"`   // stored
+}
+
+// Import reads a bundle from r into s. The digest of every blob is checked before it is kept, and
+// tags are only pointed at manifests once everything they refer to is in the store. Pinned tags are
+// left alone.
+func Import(ctx context.Context, s store.Store, pins *pin.Set, r io.Reader) (*ImportReport, error) {
+	tr := tar.NewReader(r)
+
+	var (
+		index  *Index
+		byName = map[string]Descriptor{}
+		report = &ImportReport{Models: []string{}}
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read bundle: %w", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch name := strings.TrimPrefix(hdr.Name, "./"); {
+		case name == "oci-layout":
+			var l Layout
+			if err := json.NewDecoder(tr).Decode(&l); err != nil {
+				return nil, fmt.Errorf("can't parse oci-layout: %w", err)
+			}
+			if l.ImageLayoutVersion != layoutVersion {
+				return nil, fmt.Errorf("unsupported OCI layout version %q", l.ImageLayoutVersion)
+			}
+		case name == "index.json":
+			index = &Index{}
+			if err := json.NewDecoder(tr).Decode(index); err != nil {
+				return nil, fmt.Errorf("can't parse index.json: %w", err)
+			}
+
+			for _, d := range index.Manifests {
+				n, err := blobName(d.Digest)
+				if err != nil {
+					return nil, err
+				}
+				byName[n] = d
+			}
+		case blobNameRegex.MatchString(name):
+			if index == nil {
+				return nil, errors.New("bundle has blobs before index.json")
+			}
+
+			digest := "sha256:" + strings.TrimPrefix(name, "blobs/sha256/")
+
+			var err error
+			if d, ok := byName[name]; ok {
+				err = importIndexed(ctx, s, tr, d, report)
+			} else {
+				err = importBlob(ctx, s, tr, hdr.Size, digest, report)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if index == nil {
+		return nil, errors.New("bundle has no index.json")
+	}
+
+	for _, d := range index.Manifests {
+		if err := finish(ctx, s, pins, d, report); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// importIndexed stores a manifest or Civitai model metadata from the index.
+func importIndexed(ctx context.Context, s store.Store, r io.Reader, d Descriptor, report *ImportReport) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxIndexedBlobSize+1))
+	if err != nil {
+		return fmt.Errorf("can't read %s: %w", d.Digest, err)
+	}
+	if len(data) > maxIndexedBlobSize {
+		return fmt.Errorf("%s is too big", d.Digest)
+	}
+
+	if got := download.Digest(data); got != d.Digest {
+		return fmt.Errorf("%w: wanted %s, got %s", download.ErrChecksumMismatch, d.Digest, got)
+	}
+
+	key, opts := download.ManifestKey(d.Digest), store.PutOptions{
+		ContentType: d.MediaType,
+		Metadata: map[string]string{
+			download.MetadataDigest: d.Digest,
+		},
+	}
+
+	if d.MediaType == download.CivitaiModelMediaType {
+		id := d.Annotations[AnnotationCivitaiModel]
+		if _, err := strconv.Atoi(id); err != nil {
+			return fmt.Errorf("civitai model %s has an invalid ID %q", d.Digest, id)
+		}
+
+		key, opts = "civitai/models/"+id, store.PutOptions{ContentType: download.CivitaiModelMediaType}
+	}
+
+	if err := s.Put(ctx, key, bytes.NewReader(data), int64(len(data)), opts); err != nil {
+		return fmt.Errorf("can't put %s: %w", key, err)
+	}
+
+	report.Blobs++
+	report.Bytes += int64(len(data))
+
+	return nil
+}
+
+// importBlob stores a config, layer, or Civitai file. Its digest is checked as it is stored, so a
+// blob with the wrong digest is never committed.
+func importBlob(ctx context.Context, s store.Store, r io.Reader, size int64, digest string, report *ImportReport) error {
+	key := download.BlobKey(digest)
+
+	if _, err := s.Stat(ctx, key); err == nil {
+		report.Skipped++
+		return nil
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("can't stat %s: %w", key, err)
+	}
+
+	body := download.NewVerifier(r, size, download.Checksums{
+		SHA256: strings.TrimPrefix(digest, "sha256:"),
+	})
+
+	if err := s.Put(ctx, key, body, size, store.PutOptions{
+		ContentType: "application/octet-stream",
+	}); err != nil {
+		return fmt.Errorf("can't put %s: %w", key, err)
+	}
+
+	report.Blobs++
+	report.Bytes += size
+
+	return nil
+}
+
+// finish checks that a model in the index was imported, and points its tag at it.
+func finish(ctx context.Context, s store.Store, pins *pin.Set, d Descriptor, report *ImportReport) error {
+	if d.MediaType == download.CivitaiModelMediaType {
+		report.Models = append(report.Models, "civitai:"+d.Annotations[AnnotationCivitaiModel])
+		return nil
+	}
+
+	m, err := download.LoadManifest(ctx, s, download.ManifestKey(d.Digest))
+	if err != nil {
+		return fmt.Errorf("can't load manifest %s: %w", d.Digest, err)
+	}
+
+	cached, err := download.FullyCached(ctx, s, *m)
+	if err != nil {
+		return err
+	}
+	if !cached {
+		return fmt.Errorf("bundle is missing blobs of manifest %s", d.Digest)
+	}
+
+	ref := d.Annotations[AnnotationRef]
+	if ref == "" {
+		report.Models = append(report.Models, d.Digest)
+		return nil
+	}
+
+	if strings.Contains(ref, "..") || strings.HasPrefix(ref, "/") {
+		return fmt.Errorf("manifest %s has an invalid ref %q", d.Digest, ref)
+	}
+
+	key := pin.TagKey(pin.SplitRef(ref))
+	if digest, ok := pins.Pinned(key); ok && digest != d.Digest {
+		slog.Info("tag is pinned, not moving it", "key", key, "pinned", digest, "imported", d.Digest)
+	} else if err := download.PutTag(ctx, s, key, d.Digest, d.MediaType, ""); err != nil {
+		return err
+	}
+
+	report.Models = append(report.Models, ref)
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -11,29 +12,36 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/tigrisdata-community/yukari/civitai"
 	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/gc"
+	"github.com/tigrisdata-community/yukari/internal/store"
 	"within.website/x/web"
 )
 
-func New(d *download.Downloader, c *civitai.Client, s3c *s3.Client, bucketName string) *Server {
+// errNotCached is returned when something isn't in the store and Civitai can't be asked for it.
+var errNotCached = errors.New("not cached, and yukari is offline")
+
+// New creates a Server. If offline is set, Civitai is never contacted and only models in the store
+// are served, so c can be nil.
+func New(d *download.Downloader, c *civitai.Client, s store.Store, mode store.ServeMode, access *gc.Tracker, offline bool) *Server {
 	return &Server{
-		d:          d,
-		c:          c,
-		s3c:        s3c,
-		psc:        s3.NewPresignClient(s3c),
-		bucketName: bucketName,
+		d:       d,
+		c:       c,
+		s:       s,
+		mode:    mode,
+		access:  access,
+		offline: offline,
 	}
 }
 
 type Server struct {
-	d          *download.Downloader
-	c          *civitai.Client
-	s3c        *s3.Client
-	psc        *s3.PresignClient
-	bucketName string
+	d       *download.Downloader
+	c       *civitai.Client
+	s       store.Store
+	mode    store.ServeMode
+	access  *gc.Tracker
+	offline bool
 }
 
 // /civitai/download/{modelVersion}
@@ -61,6 +69,10 @@ func (s *Server) ModelVersion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	modelVersionData, err := s.getModelVersion(r.Context(), modelVersion)
+	if errors.Is(err, errNotCached) {
+		http.Error(w, "model version isn't cached, and yukari is offline", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		lg.Error("can't fetch model version info", "modelVersion", modelVersion, "err", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
@@ -68,6 +80,10 @@ func (s *Server) ModelVersion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	modelInfo, err := s.getModel(r.Context(), strconv.Itoa(modelVersionData.ModelID))
+	if errors.Is(err, errNotCached) {
+		http.Error(w, "model isn't cached, and yukari is offline", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		lg.Error("can't fetch model info", "model", modelVersionData.ModelID, "err", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
@@ -75,7 +91,7 @@ func (s *Server) ModelVersion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.putModelMetadata(r.Context(), modelInfo); err != nil {
-		lg.Error("can't store model metadata into s3", "err", err)
+		lg.Error("can't store model metadata", "err", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -100,57 +116,37 @@ func (s *Server) ModelVersion(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	u, err := url.Parse(fmt.Sprintf("https://civitai.com/api/download/models/%d", modelVersionData.ID))
-	if err != nil {
-		panic(err)
-	}
-
-	cacheKey := fmt.Sprintf("blobs/sha256:%s", strings.ToLower(targetFile.Hashes.Sha256))
+	cacheKey := FileKey(targetFile)
 	lg = lg.With("cacheKey", cacheKey)
 
-	if _, err := s.s3c.HeadObject(r.Context(), &s3.HeadObjectInput{
-		Bucket: &s.bucketName,
-		Key:    &cacheKey,
-	}); err == nil {
+	if info, err := s.s.Stat(r.Context(), cacheKey); err == nil {
 		lg.Debug("object in bucket")
+		s.access.Touch(info.Key)
 
-		req, err := s.psc.PresignGetObject(r.Context(), &s3.GetObjectInput{
-			Bucket: &s.bucketName,
-			Key:    &cacheKey,
-		})
-		if err != nil {
-			lg.Error("can't get presigned url", "err", err)
-			http.Error(w, "can't make presigned url, sorry :(", http.StatusInternalServerError)
-			return
+		if err := store.Serve(w, r, s.s, info, s.mode); err != nil {
+			lg.Error("can't serve object from store", "err", err)
+			http.Error(w, "can't serve object from store, sorry :(", http.StatusInternalServerError)
 		}
-
-		http.Redirect(w, r, req.URL, http.StatusTemporaryRedirect)
 		return
 	}
 
-	q := u.Query()
-	q.Set("type", targetFile.Type)
-	if targetFile.Metadata.Format != "" {
-		q.Set("format", targetFile.Metadata.Format)
-	}
-	if targetFile.Metadata.Size != "" {
-		q.Set("size", targetFile.Metadata.Size)
-	}
-	if targetFile.Metadata.Fp != "" {
-		q.Set("fp", targetFile.Metadata.Fp)
+	if s.offline {
+		lg.Info("not cached and offline")
+		http.Error(w, "file isn't cached, and yukari is offline", http.StatusNotFound)
+		return
 	}
-	u.RawQuery = q.Encode()
 
-	s.d.Fetch(s.bucketName, cacheKey, u.String(), "application/octet-stream", "Bearer "+s.c.Token())
+	dlReq := DownloadRequest(s.c, modelVersionData.ID, targetFile)
+	s.d.Fetch(dlReq)
 
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, dlReq.PullURL, nil)
 	if err != nil {
 		panic(err)
 	}
 
 	redirectURL, err := getRedirectURLFor(req)
 	if err != nil {
-		slog.Error("can't get redirect url for model download", "url", u.String(), "err", err)
+		slog.Error("can't get redirect url for model download", "url", dlReq.PullURL, "err", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -159,17 +155,75 @@ func (s *Server) ModelVersion(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 }
 
+// FileKey returns the key a file of a model version is stored at.
+func FileKey(file civitai.Files) string {
+	return fmt.Sprintf("blobs/sha256:%s", strings.ToLower(file.Hashes.Sha256))
+}
+
+// DownloadRequest returns the request to cache a file of a model version.
+func DownloadRequest(c *civitai.Client, modelVersion int, file civitai.Files) download.Request {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   "civitai.com",
+		Path:   fmt.Sprintf("/api/download/models/%d", modelVersion),
+	}
+
+	q := u.Query()
+	q.Set("type", file.Type)
+	if file.Metadata.Format != "" {
+		q.Set("format", file.Metadata.Format)
+	}
+	if file.Metadata.Size != "" {
+		q.Set("size", file.Metadata.Size)
+	}
+	if file.Metadata.Fp != "" {
+		q.Set("fp", file.Metadata.Fp)
+	}
+	u.RawQuery = q.Encode()
+
+	return download.Request{
+		Key:                 FileKey(file),
+		PullURL:             u.String(),
+		MediaType:           "application/octet-stream",
+		AuthorizationHeader: "Bearer " + c.Token(),
+		Checksums: download.Checksums{
+			SHA256: file.Hashes.Sha256,
+			BLAKE3: file.Hashes.Blake3,
+			CRC32:  file.Hashes.Crc32,
+		},
+	}
+}
+
+// Authorize returns the Authorization header for downloads from Civitai, for download.Options. c is
+// nil if Civitai is disabled.
+func Authorize(c *civitai.Client) func(pullURL string) string {
+	return func(pullURL string) string {
+		u, err := url.Parse(pullURL)
+		if c == nil || err != nil || u.Host != "civitai.com" {
+			return ""
+		}
+
+		return "Bearer " + c.Token()
+	}
+}
+
 func (s *Server) putModelMetadata(ctx context.Context, modelInfo *civitai.ModelResponse) error {
-	return PutModelMetadata(ctx, s.s3c, s.bucketName, modelInfo)
+	// Offline, the metadata came from the store in the first place.
+	if s.offline {
+		return nil
+	}
+
+	return PutModelMetadata(ctx, s.s, modelInfo)
 }
 
 func (s *Server) getModel(ctx context.Context, model string) (*civitai.ModelResponse, error) {
 	cacheKey := fmt.Sprintf("civitai/models/%s", model)
 
-	_, err := s.s3c.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: &s.bucketName,
-		Key:    &cacheKey,
-	})
+	_, err := s.s.Stat(ctx, cacheKey)
+
+	if err != nil && s.offline {
+		return nil, errNotCached
+	}
 
 	if err != nil {
 		modelInfo, err := s.c.FetchModel(ctx, model)
@@ -182,11 +236,8 @@ func (s *Server) getModel(ctx context.Context, model string) (*civitai.ModelResp
 			return nil, err
 		}
 
-		if _, err := s.s3c.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:      &s.bucketName,
-			Key:         &cacheKey,
-			Body:        &data,
-			ContentType: aws.String("application/vnd.civitai.model+json"),
+		if err := s.s.Put(ctx, cacheKey, &data, int64(data.Len()), store.PutOptions{
+			ContentType: download.CivitaiModelMediaType,
 		}); err != nil {
 			return nil, err
 		}
@@ -194,10 +245,7 @@ func (s *Server) getModel(ctx context.Context, model string) (*civitai.ModelResp
 		return modelInfo, nil
 	}
 
-	resp, err := s.s3c.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &s.bucketName,
-		Key:    &cacheKey,
-	})
+	resp, err := s.s.Get(ctx, cacheKey, store.Range{})
 	if err != nil {
 		return nil, err
 	}
@@ -214,10 +262,11 @@ func (s *Server) getModel(ctx context.Context, model string) (*civitai.ModelResp
 func (s *Server) getModelVersion(ctx context.Context, modelVersion string) (*civitai.ModelVersionResponse, error) {
 	cacheKey := fmt.Sprintf("civitai/model-versions/%s", modelVersion)
 
-	_, err := s.s3c.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: &s.bucketName,
-		Key:    &cacheKey,
-	})
+	_, err := s.s.Stat(ctx, cacheKey)
+
+	if err != nil && s.offline {
+		return s.findModelVersion(ctx, modelVersion)
+	}
 
 	if err != nil {
 		modelVersionInfo, err := s.c.FetchModelVersion(ctx, modelVersion)
@@ -230,11 +279,8 @@ func (s *Server) getModelVersion(ctx context.Context, modelVersion string) (*civ
 			return nil, err
 		}
 
-		if _, err := s.s3c.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:      &s.bucketName,
-			Key:         &cacheKey,
-			Body:        &data,
-			ContentType: aws.String("application/vnd.civitai.model-version+json"),
+		if err := s.s.Put(ctx, cacheKey, &data, int64(data.Len()), store.PutOptions{
+			ContentType: "application/vnd.civitai.model-version+json",
 		}); err != nil {
 			return nil, err
 		}
@@ -242,10 +288,7 @@ func (s *Server) getModelVersion(ctx context.Context, modelVersion string) (*civ
 		return modelVersionInfo, nil
 	}
 
-	resp, err := s.s3c.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &s.bucketName,
-		Key:    &cacheKey,
-	})
+	resp, err := s.s.Get(ctx, cacheKey, store.Range{})
 	if err != nil {
 		return nil, err
 	}
@@ -259,7 +302,46 @@ func (s *Server) getModelVersion(ctx context.Context, modelVersion string) (*civ
 	return &result, nil
 }
 
-func PutModelMetadata(ctx context.Context, s3c *s3.Client, bucketName string, modelInfo *civitai.ModelResponse) error {
+// findModelVersion looks for a model version in the metadata of the models in the store. Models
+// that were warmed or imported only have their model's metadata, not their model version's.
+func (s *Server) findModelVersion(ctx context.Context, modelVersion string) (*civitai.ModelVersionResponse, error) {
+	models, err := s.s.List(ctx, store.Query{Prefix: "civitai/models/"})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range models {
+		obj, err := s.s.Get(ctx, info.Key, store.Range{})
+		if err != nil {
+			return nil, err
+		}
+
+		var model civitai.ModelResponse
+		err = json.NewDecoder(obj.Body).Decode(&model)
+		obj.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, version := range model.ModelVersions {
+			if strconv.Itoa(version.ID) != modelVersion {
+				continue
+			}
+
+			return &civitai.ModelVersionResponse{
+				ID:          version.ID,
+				ModelID:     model.ID,
+				Name:        version.Name,
+				Files:       version.Files,
+				DownloadURL: version.DownloadURL,
+			}, nil
+		}
+	}
+
+	return nil, errNotCached
+}
+
+func PutModelMetadata(ctx context.Context, s store.Store, modelInfo *civitai.ModelResponse) error {
 	var data bytes.Buffer
 	if err := json.NewEncoder(&data).Encode(modelInfo); err != nil {
 		return fmt.Errorf("can't encode model metadata: %w", err)
@@ -267,13 +349,10 @@ func PutModelMetadata(ctx context.Context, s3c *s3.Client, bucketName string, mo
 
 	key := fmt.Sprintf("civitai/models/%d", modelInfo.ID)
 
-	if _, err := s3c.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      &bucketName,
-		Key:         &key,
-		ContentType: aws.String("application/vnd.civitai.model+json"),
-		Body:        &data,
+	if err := s.Put(ctx, key, &data, int64(data.Len()), store.PutOptions{
+		ContentType: download.CivitaiModelMediaType,
 	}); err != nil {
-		return fmt.Errorf("can't write model metadata to s3: %w", err)
+		return fmt.Errorf("can't write model metadata to store: %w", err)
 	}
 
 	return nil
@@ -8,172 +8,517 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"path"
+	"os"
 	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+	"github.com/tigrisdata-community/yukari/internal/throttle"
 )
 
 var (
-	ManifestRegex = regexp.MustCompile(`/v2/([\w.]+/[\w.]+)`)
+	// ManifestRegex matches the repository name in a registry URL. Names can have any number of
+	// components, such as `library/llama3` or `hf.co/bartowski/model`.
+	ManifestRegex = regexp.MustCompile(`/v2/(.+?)/(?:manifests|blobs)/`)
+
+	// manifestMediaTypes are the content types registries that aren't the Ollama registry serve
+	// manifests with.
+	manifestMediaTypes = map[string]bool{
+		ManifestMediaType: true,
+		"application/vnd.oci.image.manifest.v1+json": true,
+	}
+
+	// ManifestAccept is sent with every request for a manifest, so that registries that pick what
+	// kind of manifest to answer with always pick the same one. Otherwise a revalidated manifest's
+	// digest might never match the cached one.
+	ManifestAccept = strings.Join([]string{
+		ManifestMediaType,
+		"application/vnd.oci.image.manifest.v1+json",
+	}, ", ")
+)
+
+const (
+	// MetadataPullURL is the object metadata key that the URL a manifest was downloaded from is
+	// stored in.
+	MetadataPullURL = "pull-url"
+
+	// MetadataDigest is the object metadata key that a manifest's digest is stored in.
+	MetadataDigest = "digest"
+
+	// maxManifestSize is the biggest manifest that will be parsed, the same limit most registries
+	// have.
+	maxManifestSize = 4 << 20
 )
 
+// Downloader downloads objects from upstream into the store in the background. Its queue is
+// persisted in the store, so pending downloads survive restarts (see Resume).
 type Downloader struct {
-	s3c      *s3.Client
-	inFlight map[string]struct{}
-	inp      chan downloadWork
+	s               store.Store
+	client          *http.Client
+	retry           RetryPolicy
+	chunkSize       int64
+	rangedThreshold int64
+	hostLimits      map[string]int
+	throttle        *throttle.Throttle
+	pins            *pin.Set
+	authorize       func(pullURL string) string
+	spoolDir        string
+	inFlight        map[string]*Job // keyed by store key
+	streams         map[string]*Stream
+	queue           []*Job
+	running         map[string]int // number of jobs being worked on per upstream host
+	cond            *sync.Cond
 
 	sync.Mutex
 }
 
-func New(s3c *s3.Client) *Downloader {
-	return &Downloader{
-		s3c:      s3c,
-		inFlight: map[string]struct{}{},
-		inp:      make(chan downloadWork, 4),
+// Options configure a Downloader. The zero value is usable.
+type Options struct {
+	Retry RetryPolicy
+
+	// Client is used to download objects from upstream. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Objects bigger than RangedThreshold are downloaded in ChunkSize ranges, each uploaded as a part
+	// of a multipart upload, if both the store and upstream support it. This lets big downloads
+	// resume where they left off. Zero values mean DefaultRangedThreshold and DefaultChunkSize.
+	RangedThreshold int64
+	ChunkSize       int64
+
+	// HostLimits caps how many jobs can download from each upstream host at once, so that one busy
+	// upstream can't take up every worker. Hosts that aren't listed are only limited by the number
+	// of workers.
+	HostLimits map[string]int
+
+	// Throttle limits the bandwidth background downloads can use. Streaming through to clients is
+	// never throttled.
+	Throttle *throttle.Throttle
+
+	// Pins are tags that are never moved to a different manifest when they are refreshed.
+	Pins *pin.Set
+
+	// SpoolDir is where objects streamed through to clients are spooled while they are saved. It
+	// needs room for every object being streamed at once. If empty, os.TempDir() is used.
+	SpoolDir string
+
+	// Authorize returns the Authorization header for a download that doesn't have one, such as one
+	// resumed after a restart. Routes with their own credentials are already authenticated by
+	// Client. If nil, those downloads are made without credentials.
+	Authorize func(pullURL string) string
+}
+
+func New(s store.Store, opts Options) *Downloader {
+	d := &Downloader{
+		s:               s,
+		client:          opts.Client,
+		retry:           opts.Retry.withDefaults(),
+		chunkSize:       opts.ChunkSize,
+		rangedThreshold: opts.RangedThreshold,
+		hostLimits:      opts.HostLimits,
+		throttle:        opts.Throttle,
+		pins:            opts.Pins,
+		authorize:       opts.Authorize,
+		spoolDir:        opts.SpoolDir,
+		inFlight:        map[string]*Job{},
+		streams:         map[string]*Stream{},
+		running:         map[string]int{},
+	}
+
+	if d.client == nil {
+		d.client = http.DefaultClient
+	}
+
+	if d.chunkSize <= 0 {
+		d.chunkSize = DefaultChunkSize
+	}
+	d.chunkSize = max(d.chunkSize, minChunkSize)
+
+	if d.spoolDir == "" {
+		d.spoolDir = os.TempDir()
+	}
+
+	if d.rangedThreshold <= 0 {
+		d.rangedThreshold = DefaultRangedThreshold
+	}
+	d.cond = sync.NewCond(&d.Mutex)
+
+	return d
+}
+
+// Fetch queues req for download unless the same object is already queued or being downloaded.
+func (d *Downloader) Fetch(req Request) {
+	now := time.Now()
+	j := &Job{
+		Request:   req,
+		ID:        jobID(req.Key),
+		State:     JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	d.Lock()
+	_, found := d.inFlight[req.Key]
+	d.Unlock()
+
+	if found {
+		return
+	}
+
+	if !d.enqueue(j) {
+		return
+	}
+
+	// Saving the job is kept off of the request path that queued it.
+	go func() {
+		if err := d.saveJob(context.Background(), j); err != nil {
+			slog.Error("can't persist download job, it will not survive a restart", "job", j, "err", err)
+		}
+	}()
+}
+
+// authorization returns the Authorization header to download j with.
+func (d *Downloader) authorization(j *Job) string {
+	if j.AuthorizationHeader != "" || d.authorize == nil {
+		return j.AuthorizationHeader
 	}
+
+	return d.authorize(j.PullURL)
 }
 
-type downloadWork struct {
-	bucket, key, pullURL, mediaType, authorizationHeader string
+// enqueue adds j to the in-memory queue, returning false if the same object is already in flight.
+func (d *Downloader) enqueue(j *Job) bool {
+	if !d.track(j) {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.queue = append(d.queue, j)
+	d.cond.Signal()
+
+	return true
 }
 
-func (d downloadWork) LogValue() slog.Value {
-	return slog.GroupValue(
-		slog.String("bucket", d.bucket),
-		slog.String("key", d.key),
-		slog.String("pullURL", d.pullURL),
-		slog.String("mediaType", d.mediaType),
-		slog.Bool("hasAuthzHeader", d.authorizationHeader != ""),
-	)
+// track adds j to the in-flight set without queueing it, returning false if the same object is
+// already in flight.
+func (d *Downloader) track(j *Job) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, found := d.inFlight[j.Key]; found {
+		return false
+	}
+
+	d.inFlight[j.Key] = j
+	return true
 }
 
-func (d *Downloader) Fetch(bucket, key, pullURL, mediaType, authorizationHeader string) {
+// next blocks until there is a job in the queue whose upstream host isn't at its limit, or ctx is
+// done. The caller must call done with the job once it has finished working on it.
+func (d *Downloader) next(ctx context.Context) (*Job, bool) {
+	stop := context.AfterFunc(ctx, func() {
+		d.Lock()
+		d.cond.Broadcast()
+		d.Unlock()
+	})
+	defer stop()
+
+	d.Lock()
+	defer d.Unlock()
+
+	for {
+		if ctx.Err() != nil {
+			return nil, false
+		}
+
+		for i, j := range d.queue {
+			host := j.host()
+			if limit, ok := d.hostLimits[host]; ok && d.running[host] >= limit {
+				continue
+			}
+
+			d.queue = slices.Delete(d.queue, i, i+1)
+			d.running[host]++
+			return j, true
+		}
+
+		d.cond.Wait()
+	}
+}
+
+// done marks j as no longer being worked on, letting another job from the same host start.
+func (d *Downloader) done(j *Job) {
+	d.Lock()
+	defer d.Unlock()
+
+	host := j.host()
+	d.running[host]--
+	if d.running[host] <= 0 {
+		delete(d.running, host)
+	}
+	d.cond.Signal()
+}
+
+// finish records the outcome of a job. Failed jobs are retried with backoff until they run out of
+// attempts, at which point they are kept in the store as dead letters. Either way, once a job is
+// done or dead it is removed from the in-flight set so that it can be fetched again.
+func (d *Downloader) finish(ctx context.Context, j *Job, err error) {
+	if err == nil {
+		d.setState(j, JobDone, nil)
+
+		// The job is deleted before it is forgotten, so that deleting it can't race with saving the
+		// next job for the same object.
+		if err := d.deleteJob(ctx, j); err != nil {
+			slog.Error("can't delete finished job", "job", j, "err", err)
+		}
+
+		d.forget(j)
+		return
+	}
+
 	d.Lock()
-	_, found := d.inFlight[pullURL]
+	j.Attempts++
 	d.Unlock()
 
-	if found {
+	if j.Attempts >= d.retry.MaxAttempts {
+		slog.Error("giving up on job", "job", j, "attempts", j.Attempts, "err", err)
+		d.abortUpload(ctx, j)
+		d.setState(j, JobFailed, err)
+		d.forget(j)
+
+		if err := d.saveJob(ctx, j); err != nil {
+			slog.Error("can't persist failed job", "job", j, "err", err)
+		}
 		return
 	}
 
-	d.inp <- downloadWork{bucket, key, pullURL, mediaType, authorizationHeader}
+	delay := d.retry.Backoff(j.Attempts)
 
 	d.Lock()
-	d.inFlight[pullURL] = struct{}{}
+	j.NextAttempt = time.Now().Add(delay)
 	d.Unlock()
+	d.setState(j, JobQueued, err)
+
+	slog.Info("retrying job later", "job", j, "attempts", j.Attempts, "in", delay.String())
+
+	if err := d.saveJob(ctx, j); err != nil {
+		slog.Error("can't persist job state", "job", j, "err", err)
+	}
+
+	d.requeueAfter(j, delay)
+}
+
+// requeueAfter puts an in-flight job back on the queue after delay.
+func (d *Downloader) requeueAfter(j *Job, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		d.Lock()
+		defer d.Unlock()
+
+		d.queue = append(d.queue, j)
+		d.cond.Signal()
+	})
+}
+
+func (d *Downloader) forget(j *Job) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.inFlight, j.Key)
+}
+
+func (d *Downloader) setState(j *Job, state JobState, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	j.State = state
+	j.Error = ""
+	if err != nil {
+		j.Error = err.Error()
+	}
 }
 
 func (d *Downloader) Work(ctx context.Context) {
 	d.work(ctx)
 }
 
+// work runs jobs until ctx is canceled. A job failing (or even panicking) never stops the worker.
 func (d *Downloader) work(ctx context.Context) {
 	for {
-		select {
-		case <-ctx.Done():
+		j, ok := d.next(ctx)
+		if !ok {
 			slog.Info("returning from downloader work thread")
 			return
-		case work, ok := <-d.inp:
-			if !ok {
-				return
-			}
+		}
 
-			lg := slog.With(
-				"component", "downloader",
-				"work", work,
-			)
+		lg := slog.With(
+			"component", "downloader",
+			"job", j,
+		)
 
-			if _, err := d.s3c.HeadObject(ctx, &s3.HeadObjectInput{
-				Bucket: &work.bucket,
-				Key:    &work.key,
-			}); err == nil {
-				lg.Debug("object already in bucket, skipping")
-				continue
-			}
+		err := d.safeProcess(ctx, lg, j)
+		d.done(j)
+		if err != nil {
+			lg.Error("can't download", "err", err)
+		}
 
-			lg.Info("fetching")
+		d.finish(ctx, j, err)
+	}
+}
 
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, work.pullURL, nil)
-			if err != nil {
-				lg.Error("can't make request", "err", err)
-			}
+func (d *Downloader) safeProcess(ctx context.Context, lg *slog.Logger, j *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while downloading: %v", r)
+		}
+	}()
 
-			req.Header.Set("Authorization", work.authorizationHeader)
+	return d.process(ctx, lg, j)
+}
 
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				lg.Error("can't fetch from remote", "err", err)
-				continue
-			}
-			defer resp.Body.Close()
+func (d *Downloader) process(ctx context.Context, lg *slog.Logger, j *Job) error {
+	if _, err := d.s.Stat(ctx, j.Key); err == nil && !j.Refresh {
+		lg.Debug("object already in bucket, skipping")
+		d.abortUpload(ctx, j)
+		return nil
+	}
 
-			if resp.StatusCode != http.StatusOK {
-				lg.Error("can't download, wrong status", "u", resp.Request.URL.String(), "wantStatus", http.StatusOK, "gotStatus", resp.StatusCode)
-				continue
-			}
+	if d.streaming(j.Key) {
+		lg.Debug("object is being streamed through from upstream, skipping")
+		return nil
+	}
 
-			mt := resp.Header.Get("Content-Type")
-			// NOTE(Xe): God is dead. The Ollama registry returns text/plain here when they should
-			// really return application/json, or ideally application/vnd.docker.distribution.manifest.v2+json.
-			// We have to treat JSON as if it's not JSON here. I hate it too.
-			if mt == "text/plain; charset=utf-8" {
-				if err := d.hackHandleManifests(&work, resp); err != nil {
-					lg.Error("can't hackily handle manifests", "err", err)
-				}
-			}
+	d.setState(j, JobRunning, nil)
+	if err := d.saveJob(ctx, j); err != nil {
+		lg.Error("can't persist job state", "err", err)
+	}
 
-			if _, err := d.s3c.PutObject(ctx, &s3.PutObjectInput{
-				Bucket:             &work.bucket,
-				Key:                &work.key,
-				ContentType:        &work.mediaType,
-				Body:               resp.Body,
-				ContentLength:      &resp.ContentLength,
-				ContentDisposition: aws.String(resp.Header.Get("Content-Disposition")),
-			}); err != nil {
-				lg.Error("can't put, retrying", "err", err)
-				go d.Fetch(work.bucket, work.key, work.pullURL, work.mediaType, work.authorizationHeader)
-				return
-			}
+	if j.Upload != nil {
+		return d.processRanged(ctx, lg, j, j.Upload.Size, "")
+	}
+
+	lg.Info("fetching")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.PullURL, nil)
+	if err != nil {
+		return fmt.Errorf("can't make request: %w", err)
+	}
+
+	if authorization := d.authorization(j); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if isManifestJob(j.Key) {
+		req.Header.Set("Accept", ManifestAccept)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't fetch from remote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("can't download %s, wrong status: want %d, got %d", resp.Request.URL, http.StatusOK, resp.StatusCode)
+	}
+
+	if d.wantRanged(resp) {
+		lg.Info("switching to ranged download", "size", resp.ContentLength)
+		resp.Body.Close()
+		return d.processRanged(ctx, lg, j, resp.ContentLength, resp.Header.Get("Content-Disposition"))
+	}
+
+	mt := resp.Header.Get("Content-Type")
+	// NOTE(Xe): God is dead. The Ollama registry returns text/plain here when they should
+	// really return application/json, or ideally application/vnd.docker.distribution.manifest.v2+json.
+	// We have to treat JSON as if it's not JSON here. I hate it too. Blobs (such as an Ollama
+	// template or params layer) can be JSON served as text/plain too, so only manifest keys count.
+	if isManifestJob(j.Key) && (mt == "text/plain; charset=utf-8" || manifestMediaTypes[mt]) {
+		data, digest, err := d.hackHandleManifests(j, resp)
+		if err == nil {
+			return d.putManifest(ctx, j, data, digest)
 		}
+
+		lg.Error("can't hackily handle manifests", "err", err)
+	}
+
+	d.startProgress(j, 0, resp.ContentLength)
+
+	body := d.throttle.Reader(ctx, j.host(), countingReader{resp.Body, &j.progress})
+	if sums := checksumsFor(j.Key, j.Checksums); !sums.empty() {
+		body = newVerifier(body, resp.ContentLength, sums)
 	}
+
+	if err := d.s.Put(ctx, j.Key, body, resp.ContentLength, store.PutOptions{
+		ContentType:        j.MediaType,
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+	}); err != nil {
+		return fmt.Errorf("can't put: %w", err)
+	}
+
+	return nil
 }
 
-func (d *Downloader) hackHandleManifests(work *downloadWork, resp *http.Response) error {
-	rd := io.LimitReader(resp.Body, 4*4096) // at most 16k of json
+// hackHandleManifests parses a manifest response, queues its blobs for download, and returns it
+// with its digest. resp.Body is left intact.
+func (d *Downloader) hackHandleManifests(j *Job, resp *http.Response) ([]byte, string, error) {
+	rd := io.LimitReader(resp.Body, maxManifestSize+1)
 	data, err := io.ReadAll(rd)
 	if err != nil {
-		return fmt.Errorf("can't read data: %w", err)
+		return nil, "", fmt.Errorf("can't read data: %w", err)
+	}
+
+	// cheeky stuff here, put data into a buffer, and then place that in
+	// resp's body. This is done before parsing so that the body is intact
+	// even if it's not actually a manifest.
+	buf := bytes.NewBuffer(data)
+	resp.Body = io.NopCloser(io.MultiReader(buf, resp.Body))
+
+	if len(data) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest is bigger than %d bytes", maxManifestSize)
 	}
 
 	var manifest Manifest
 	if err := json.Unmarshal(data, &manifest); err != nil {
-		return fmt.Errorf("can't parse manifest: %w", err)
+		return nil, "", fmt.Errorf("can't parse manifest: %w", err)
 	}
 
-	// cheeky stuff here, put data into a buffer, and then place that in
-	// resp's body.
-	buf := bytes.NewBuffer(data)
-	resp.Body = io.NopCloser(buf)
-	resp.ContentLength = int64(buf.Len())
+	j.MediaType = manifest.MediaType
+
+	go d.FetchBlobs(manifest, j.PullURL, d.authorization(j))
 
-	work.mediaType = manifest.MediaType
+	return data, Digest(data), nil
+}
 
-	var imageName string
-	matches := ManifestRegex.FindStringSubmatch(work.pullURL)
-	if len(matches) == 2 {
-		imageName = matches[1]
+// FetchBlobs queues the config blob and every layer of a manifest that was pulled from manifestURL.
+// The blobs are fetched from the same registry and repository as the manifest.
+func (d *Downloader) FetchBlobs(m Manifest, manifestURL, authorizationHeader string) {
+	repoURL, ok := repositoryURL(manifestURL)
+	if !ok {
+		slog.Error("can't find repository in manifest URL, not fetching blobs", "manifestURL", manifestURL)
+		return
 	}
 
-	urlBase := fmt.Sprintf("https://registry.ollama.ai/v2/%s", imageName)
+	for _, blob := range m.Blobs() {
+		d.Fetch(Request{
+			Key:                 BlobKey(blob.Digest),
+			PullURL:             repoURL + "/blobs/" + blob.Digest,
+			MediaType:           blob.MediaType,
+			AuthorizationHeader: authorizationHeader,
+		})
+	}
+}
 
-	go func(manifest Manifest, urlBase string) {
-		for _, layer := range manifest.Layers {
-			d.Fetch(work.bucket, path.Join("blobs", layer.Digest), urlBase+"/"+path.Join("blobs", layer.Digest), layer.MediaType, work.authorizationHeader)
-		}
-	}(manifest, urlBase)
+// repositoryURL strips the `/manifests/<reference>` suffix off of a manifest URL, leaving the URL of
+// the repository it is in (such as `https://registry.ollama.ai/v2/library/llama3`).
+func repositoryURL(manifestURL string) (string, bool) {
+	i := strings.LastIndex(manifestURL, "/manifests/")
+	if i == -1 {
+		return "", false
+	}
 
-	return nil
+	return manifestURL[:i], true
 }
@@ -0,0 +1,642 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// testBlob is where "i am a model layer" is stored.
+const testBlob = "blobs/sha256:4dc7aa34615388a266ce5e58cd0e7ad5a8a0af358d2d100b509f723305eb38bb"
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResume(t *testing.T) {
+	const authorization = "Bearer hunter2"
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			http.Error(w, "who are you", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, "i am a model layer")
+	}))
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewMemory()
+
+	// queue a job on a downloader that never runs, like a pod that was killed
+	New(s, Options{}).Fetch(Request{
+		Key:                 testBlob,
+		PullURL:             origin.URL + "/v2/library/llama3/" + testBlob,
+		AuthorizationHeader: authorization,
+	})
+
+	waitFor(t, "job to be persisted", func() bool {
+		jobs, err := s.List(ctx, store.Query{Prefix: jobPrefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(jobs) == 1
+	})
+
+	obj, err := s.Get(ctx, jobPrefix+jobID(testBlob), store.Range{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(obj.Body)
+	obj.Body.Close()
+
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Fatalf("credentials were persisted: %s", data)
+	}
+
+	// credentials come from Authorize once the job is resumed
+	d := New(s, Options{
+		Authorize: func(string) string { return authorization },
+	})
+	if err := d.Resume(ctx); err != nil {
+		t.Fatalf("can't resume: %v", err)
+	}
+	go d.Work(ctx)
+
+	waitFor(t, "job to finish", func() bool {
+		jobs, err := s.List(ctx, store.Query{Prefix: jobPrefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(jobs) == 0
+	})
+
+	if _, err := s.Stat(ctx, testBlob); err != nil {
+		t.Fatalf("object was not downloaded: %v", err)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if len(d.inFlight) != 0 {
+		t.Fatalf("finished job was not removed from the in-flight set: %v", d.inFlight)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, "i am a model layer")
+	}))
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewMemory()
+	d := New(s, Options{
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    time.Millisecond,
+		},
+	})
+	go d.Work(ctx)
+
+	d.Fetch(Request{Key: "blobs/sha256:broken", PullURL: origin.URL + "/broken"})
+
+	var deadLetters []Status
+	waitFor(t, "job to be dead-lettered", func() bool {
+		var err error
+		deadLetters, err = d.DeadLetters(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(deadLetters) == 1
+	})
+
+	if deadLetters[0].Attempts != 3 {
+		t.Fatalf("wanted 3 attempts, got %d", deadLetters[0].Attempts)
+	}
+
+	// the worker must still be alive after giving up on a job
+	d.Fetch(Request{Key: testBlob, PullURL: origin.URL + "/works"})
+	waitFor(t, "second job to finish", func() bool {
+		_, err := s.Stat(ctx, testBlob)
+		return err == nil
+	})
+
+	if err := d.DeleteDeadLetter(ctx, deadLetters[0].ID); err != nil {
+		t.Fatalf("can't delete dead letter: %v", err)
+	}
+
+	if deadLetters, err := d.DeadLetters(ctx); err != nil || len(deadLetters) != 0 {
+		t.Fatalf("dead letter was not deleted: %v %v", deadLetters, err)
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	const data = "i am a model layer"
+
+	for _, cs := range []struct {
+		name string
+		sums Checksums
+		size int64
+		ok   bool
+	}{
+		{"sha256", Checksums{SHA256: "4dc7aa34615388a266ce5e58cd0e7ad5a8a0af358d2d100b509f723305eb38bb"}, -1, true},
+		{"sha256Uppercase", Checksums{SHA256: "4DC7AA34615388A266CE5E58CD0E7AD5A8A0AF358D2D100B509F723305EB38BB"}, int64(len(data)), true},
+		{"crc32", Checksums{CRC32: "3232A91D"}, -1, true},
+		{"blake3", Checksums{BLAKE3: "9f0a3349f13de82d1ddbc14d9973301f3b1030a6d46263f22e113f3c3a74671f"}, -1, true},
+		{"wrongSize", Checksums{SHA256: "4dc7aa34615388a266ce5e58cd0e7ad5a8a0af358d2d100b509f723305eb38bb"}, 4096, false},
+		{"wrongSHA256", Checksums{SHA256: "0000000000000000000000000000000000000000000000000000000000000000"}, int64(len(data)), false},
+	} {
+		t.Run(cs.name, func(t *testing.T) {
+			got, err := io.ReadAll(newVerifier(strings.NewReader(data), cs.size, cs.sums))
+			if cs.ok {
+				if err != nil {
+					t.Fatalf("wanted no error, got: %v", err)
+				}
+
+				if string(got) != data {
+					t.Fatalf("wanted %q, got %q", data, got)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrChecksumMismatch) {
+				t.Fatalf("wanted ErrChecksumMismatch, got: %v", err)
+			}
+
+			if cs.size == int64(len(data)) && len(got) == len(data) {
+				t.Fatal("verifier let the whole body through on a mismatch")
+			}
+		})
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, "i am a tampered model layer")
+	}))
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewMemory()
+	d := New(s, Options{Retry: RetryPolicy{MaxAttempts: 1}})
+	go d.Work(ctx)
+
+	d.Fetch(Request{Key: testBlob, PullURL: origin.URL + "/" + testBlob})
+
+	var deadLetters []Status
+	waitFor(t, "job to be dead-lettered", func() bool {
+		var err error
+		deadLetters, err = d.DeadLetters(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(deadLetters) == 1
+	})
+
+	if !strings.Contains(deadLetters[0].Error, ErrChecksumMismatch.Error()) {
+		t.Fatalf("wrong error for dead letter: %s", deadLetters[0].Error)
+	}
+
+	if _, err := s.Stat(ctx, testBlob); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("tampered blob made it into the store: %v", err)
+	}
+}
+
+func TestRangedResume(t *testing.T) {
+	data := bytes.Repeat([]byte("i am a very big model layer\n"), 512<<10) // 14 MiB
+	sum := sha256.Sum256(data)
+	key := "blobs/sha256:" + hex.EncodeToString(sum[:])
+
+	var (
+		lock    sync.Mutex
+		offsets []string
+		failed  bool
+	)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+
+		lock.Lock()
+		offsets = append(offsets, rng)
+		// die partway through the download, once
+		fail := !failed && strings.HasPrefix(rng, fmt.Sprintf("bytes=%d-", minChunkSize))
+		if fail {
+			failed = true
+		}
+		lock.Unlock()
+
+		if fail {
+			http.Error(w, "connection reset by peer", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := store.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(s, Options{
+		Retry: RetryPolicy{
+			BaseDelay: time.Millisecond,
+			MaxDelay:  time.Millisecond,
+		},
+		RangedThreshold: minChunkSize,
+		ChunkSize:       minChunkSize,
+	})
+	go d.Work(ctx)
+
+	d.Fetch(Request{Key: key, PullURL: origin.URL + "/" + key})
+
+	waitFor(t, "object to be downloaded", func() bool {
+		_, err := s.Stat(ctx, key)
+		return err == nil
+	})
+
+	obj, err := s.Get(ctx, key, store.Range{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+
+	got, err := io.ReadAll(obj.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded object is corrupt: got %d bytes, want %d", len(got), len(data))
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	want := []string{
+		"", // the first request that finds out the object is big
+		fmt.Sprintf("bytes=0-%d", minChunkSize-1),
+		fmt.Sprintf("bytes=%d-%d", minChunkSize, 2*minChunkSize-1), // fails
+		fmt.Sprintf("bytes=%d-%d", minChunkSize, 2*minChunkSize-1),
+		fmt.Sprintf("bytes=%d-%d", 2*minChunkSize, len(data)-1),
+	}
+
+	if !slices.Equal(offsets, want) {
+		t.Fatalf("wrong requests to upstream:\ngot:  %q\nwant: %q", offsets, want)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	j := &Job{
+		Request: Request{Key: testBlob, AuthorizationHeader: "Bearer hunter2"},
+		State:   JobRunning,
+	}
+
+	j.progress.started = time.Now().Add(-10 * time.Second)
+	j.progress.total.Store(2000)
+	j.progress.done.Store(1000)
+
+	st := j.status()
+
+	if st.BytesDone != 1000 || st.BytesTotal != 2000 {
+		t.Fatalf("wrong byte counts: got %d/%d", st.BytesDone, st.BytesTotal)
+	}
+
+	if st.BytesPerSecond < 90 || st.BytesPerSecond > 100 {
+		t.Fatalf("wrong rate: got %d bytes per second, want about 100", st.BytesPerSecond)
+	}
+
+	if st.ETA == "" {
+		t.Fatal("no ETA for a job with a known size")
+	}
+
+	if !st.HasAuthorizationHeader {
+		t.Fatal("status doesn't say the job has an authorization header")
+	}
+}
+
+func TestFullyCached(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	m := Manifest{
+		Config: Config{Digest: "sha256:config"},
+		Layers: []Layers{{Digest: "sha256:layer"}},
+	}
+
+	if blobs := m.Blobs(); len(blobs) != 2 || blobs[0].Digest != "sha256:config" {
+		t.Fatalf("config blob is not the first blob: %v", blobs)
+	}
+
+	check := func(want bool) {
+		t.Helper()
+
+		got, err := FullyCached(ctx, s, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Fatalf("FullyCached: got %v, want %v", got, want)
+		}
+	}
+
+	if err := s.Put(ctx, "blobs/sha256:layer", strings.NewReader("layer"), 5, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+
+	if err := s.Put(ctx, "blobs/sha256:config", strings.NewReader("{}"), 2, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+}
+
+func TestManifestFetchesBlobsFromSameUpstream(t *testing.T) {
+	config := []byte(`{"model_format":"gguf"}`)
+	layer := []byte("i am a model layer")
+
+	digest := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"digest":%q,"size":%d},"layers":[{"digest":%q,"size":%d}]}`, digest(config), len(config), digest(layer), len(layer))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mirror/v2/library/llama3/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, manifest)
+	})
+	for _, blob := range [][]byte{config, layer} {
+		mux.HandleFunc("/mirror/v2/library/llama3/blobs/"+digest(blob), func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(blob)
+		})
+	}
+
+	origin := httptest.NewServer(mux)
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewMemory()
+	d := New(s, Options{})
+	go d.Work(ctx)
+
+	manifestURL := origin.URL + "/mirror/v2/library/llama3/manifests/latest"
+	d.Fetch(Request{Key: "v2/library/llama3/manifests/latest", PullURL: manifestURL})
+
+	var m *Manifest
+	waitFor(t, "model to be fully cached", func() bool {
+		var err error
+		if m == nil {
+			if m, err = LoadManifest(ctx, s, "v2/library/llama3/manifests/latest"); err != nil {
+				return false
+			}
+		}
+
+		cached, err := FullyCached(ctx, s, *m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return cached
+	})
+
+	info, err := s.Stat(ctx, "v2/library/llama3/manifests/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := info.Metadata[MetadataPullURL]; got != manifestURL {
+		t.Fatalf("wrong pull URL recorded for manifest: got %q, want %q", got, manifestURL)
+	}
+
+	if got, want := info.Metadata[MetadataDigest], Digest([]byte(manifest)); got != want {
+		t.Fatalf("wrong digest recorded for manifest: got %q, want %q", got, want)
+	}
+}
+
+func TestTagHistory(t *testing.T) {
+	manifests := []string{
+		`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`,
+		`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":null}`,
+	}
+
+	var current atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		io.WriteString(w, manifests[current.Load()])
+	}))
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewMemory()
+	d := New(s, Options{})
+	go d.Work(ctx)
+
+	const key = "v2/library/llama3/manifests/latest"
+
+	for i, manifest := range manifests {
+		current.Store(int64(i))
+		d.Fetch(Request{Key: key, PullURL: origin.URL + "/" + key, Refresh: true})
+
+		waitFor(t, "tag to point at the new manifest", func() bool {
+			tag, err := LoadTag(ctx, s, key)
+			return err == nil && tag.Digest == Digest([]byte(manifest))
+		})
+	}
+
+	tag, err := LoadTag(ctx, s, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tag.History) != len(manifests) {
+		t.Fatalf("wanted %d history entries, got %d", len(manifests), len(tag.History))
+	}
+
+	for i, manifest := range manifests {
+		if got, want := tag.History[i].Digest, Digest([]byte(manifest)); got != want {
+			t.Errorf("wrong digest in history entry %d: got %q, want %q", i, got, want)
+		}
+	}
+
+	if got, want := tag.Digest, Digest([]byte(manifests[1])); got != want {
+		t.Fatalf("tag points at the wrong manifest: got %q, want %q", got, want)
+	}
+
+	// The old manifest can still be pulled by digest after the tag moved.
+	obj, err := OpenManifest(ctx, s, ManifestKey(tag.History[0].Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+
+	if data, _ := io.ReadAll(obj.Body); string(data) != manifests[0] {
+		t.Fatalf("wrong old manifest: %q", data)
+	}
+}
+
+func TestJSONBlobIsNotAManifest(t *testing.T) {
+	// Ollama's params layers are JSON, and the registry serves them as text/plain.
+	const params = `{"stop":["<|eot_id|>"]}`
+	key := BlobKey(Digest([]byte(params)))
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, params)
+	}))
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewMemory()
+	d := New(s, Options{})
+	go d.Work(ctx)
+
+	d.Fetch(Request{Key: key, PullURL: origin.URL + "/v2/library/llama3/" + key})
+
+	waitFor(t, "blob to be cached", func() bool {
+		_, err := s.Stat(ctx, key)
+		return err == nil
+	})
+
+	obj, err := s.Get(ctx, key, store.Range{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+
+	if obj.ContentType == TagMediaType {
+		t.Fatal("blob was stored as a tag")
+	}
+
+	if data, _ := io.ReadAll(obj.Body); string(data) != params {
+		t.Fatalf("blob wasn't stored intact: %q", data)
+	}
+}
+
+func TestStreamThroughNeedsSpoolSpace(t *testing.T) {
+	if _, err := freeSpace(t.TempDir()); err != nil {
+		t.Skipf("can't check free space here: %v", err)
+	}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// far bigger than any disk, and never sent
+		w.Header().Set("Content-Length", "1152921504606846976")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer origin.Close()
+
+	d := New(store.NewMemory(), Options{SpoolDir: t.TempDir()})
+
+	_, _, err := d.StreamThrough(context.Background(), Request{Key: testBlob, PullURL: origin.URL}, func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return http.DefaultClient.Do(req)
+	})
+	if err == nil {
+		t.Fatal("streamed an object that can't fit in the spool directory")
+	}
+}
+
+func TestManifestAccept(t *testing.T) {
+	const (
+		accepted = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`
+		fallback = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	)
+
+	// Like most registries, origin picks what kind of manifest to send from the Accept header.
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != ManifestAccept {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			io.WriteString(w, fallback)
+			return
+		}
+
+		w.Header().Set("Content-Type", ManifestMediaType)
+		io.WriteString(w, accepted)
+	}))
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewMemory()
+	d := New(s, Options{})
+	go d.Work(ctx)
+
+	const key = "v2/library/llama3/manifests/latest"
+	d.Fetch(Request{Key: key, PullURL: origin.URL + "/" + key})
+
+	waitFor(t, "manifest to be cached", func() bool {
+		_, err := s.Stat(ctx, key)
+		return err == nil
+	})
+
+	tag, err := LoadTag(ctx, s, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := tag.Digest, Digest([]byte(accepted)); got != want {
+		t.Fatalf("wrong manifest cached: got digest %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,303 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+const (
+	// jobPrefix is where download jobs are kept in the store so that they survive restarts.
+	jobPrefix = "yukari/jobs/"
+
+	jobContentType = "application/vnd.yukari.download-job+json"
+)
+
+// JobState is the state of a download job.
+type JobState string
+
+// Possible job states. Done jobs are deleted from the store, so they are only ever seen in memory.
+const (
+	JobQueued  JobState = "queued"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	JobFailed  JobState = "failed"
+)
+
+// Request is a request to download an object from upstream into the store.
+//
+// AuthorizationHeader is never persisted, so that credentials aren't readable by anyone who can read
+// the bucket. Jobs that are resumed or retried get theirs from Options.Authorize instead.
+type Request struct {
+	Key                 string    `json:"key"`
+	PullURL             string    `json:"pullURL"`
+	MediaType           string    `json:"mediaType,omitempty"`
+	AuthorizationHeader string    `json:"-"`
+	Checksums           Checksums `json:"checksums"`
+
+	// Refresh downloads the object even if it is already in the store, for objects that can change
+	// upstream like manifests fetched by tag.
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+// Job is a Request and everything the downloader knows about its progress.
+type Job struct {
+	Request
+	ID          string    `json:"id"`
+	State       JobState  `json:"state"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"` // the most recent error, if any
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+	Upload      *Upload   `json:"upload,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+
+	progress progress
+
+	persist sync.Mutex // held while the job is saved or deleted
+	deleted bool       // once deleted, the job is never saved again
+}
+
+// Status is the externally visible state of a job. Unlike a Job, it never contains credentials.
+type Status struct {
+	ID                     string    `json:"id"`
+	Key                    string    `json:"key"`
+	PullURL                string    `json:"pullURL"`
+	MediaType              string    `json:"mediaType,omitempty"`
+	HasAuthorizationHeader bool      `json:"hasAuthorizationHeader"`
+	State                  JobState  `json:"state"`
+	Attempts               int       `json:"attempts"`
+	Error                  string    `json:"error,omitempty"`
+	NextAttempt            time.Time `json:"nextAttempt,omitempty"`
+	CreatedAt              time.Time `json:"createdAt"`
+	UpdatedAt              time.Time `json:"updatedAt"`
+
+	// Progress of running jobs.
+	BytesDone      int64  `json:"bytesDone,omitempty"`
+	BytesTotal     int64  `json:"bytesTotal,omitempty"` // unset if upstream didn't say
+	BytesPerSecond int64  `json:"bytesPerSecond,omitempty"`
+	ETA            string `json:"eta,omitempty"`
+}
+
+func (j *Job) status() Status {
+	st := Status{
+		ID:                     j.ID,
+		Key:                    j.Key,
+		PullURL:                j.PullURL,
+		MediaType:              j.MediaType,
+		HasAuthorizationHeader: j.AuthorizationHeader != "",
+		State:                  j.State,
+		Attempts:               j.Attempts,
+		Error:                  j.Error,
+		NextAttempt:            j.NextAttempt,
+		CreatedAt:              j.CreatedAt,
+		UpdatedAt:              j.UpdatedAt,
+	}
+
+	j.fillProgress(&st)
+
+	return st
+}
+
+func (j *Job) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", j.ID),
+		slog.String("key", j.Key),
+		slog.String("pullURL", j.PullURL),
+		slog.String("mediaType", j.MediaType),
+		slog.Bool("hasAuthzHeader", j.AuthorizationHeader != ""),
+		slog.String("state", string(j.State)),
+		slog.Int("attempts", j.Attempts),
+	)
+}
+
+// host returns the upstream host that j downloads from.
+func (j *Job) host() string {
+	u, err := url.Parse(j.PullURL)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+// jobID is derived from the key being downloaded, so there is only ever one job per object.
+func jobID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Downloader) saveJob(ctx context.Context, j *Job) error {
+	j.persist.Lock()
+	defer j.persist.Unlock()
+
+	// Jobs are saved in the background when they are queued, which can finish after the job.
+	if j.deleted {
+		return nil
+	}
+
+	d.Lock()
+	j.UpdatedAt = time.Now()
+	data, err := json.Marshal(j)
+	d.Unlock()
+	if err != nil {
+		return fmt.Errorf("can't encode job: %w", err)
+	}
+
+	if err := d.s.Put(ctx, jobPrefix+j.ID, bytes.NewReader(data), int64(len(data)), store.PutOptions{
+		ContentType: jobContentType,
+	}); err != nil {
+		return fmt.Errorf("can't save job %s: %w", j.ID, err)
+	}
+
+	return nil
+}
+
+func (d *Downloader) deleteJob(ctx context.Context, j *Job) error {
+	j.persist.Lock()
+	defer j.persist.Unlock()
+
+	j.deleted = true
+
+	if err := d.s.Delete(ctx, jobPrefix+j.ID); err != nil {
+		return fmt.Errorf("can't delete job %s: %w", j.ID, err)
+	}
+
+	return nil
+}
+
+func (d *Downloader) loadJobs(ctx context.Context) ([]*Job, error) {
+	objects, err := d.s.List(ctx, store.Query{Prefix: jobPrefix})
+	if err != nil {
+		return nil, fmt.Errorf("can't list jobs: %w", err)
+	}
+
+	var result []*Job
+
+	for _, obj := range objects {
+		o, err := d.s.Get(ctx, obj.Key, store.Range{})
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		var j Job
+		err = json.NewDecoder(o.Body).Decode(&j)
+		o.Body.Close()
+		if err != nil {
+			slog.Error("can't decode job, skipping", "key", obj.Key, "err", err)
+			continue
+		}
+
+		result = append(result, &j)
+	}
+
+	return result, nil
+}
+
+// Resume re-queues every job that was queued or running when Yukari last stopped. Call this once
+// at startup.
+//
+// When several replicas share a bucket they will all resume the same jobs. This is safe, as the
+// downloader skips objects that are already in the store.
+func (d *Downloader) Resume(ctx context.Context) error {
+	jobs, err := d.loadJobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	var resumed int
+
+	for _, j := range jobs {
+		switch j.State {
+		case JobQueued, JobRunning:
+		default:
+			continue
+		}
+
+		j.State = JobQueued
+		if delay := time.Until(j.NextAttempt); delay > 0 {
+			if d.track(j) {
+				d.requeueAfter(j, delay)
+				resumed++
+			}
+			continue
+		}
+
+		if d.enqueue(j) {
+			resumed++
+		}
+	}
+
+	slog.Info("resumed download jobs", "count", resumed)
+
+	return nil
+}
+
+// DeadLetters returns every job that ran out of attempts.
+func (d *Downloader) DeadLetters(ctx context.Context) ([]Status, error) {
+	jobs, err := d.loadJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Status{}
+	for _, j := range jobs {
+		if j.State == JobFailed {
+			result = append(result, j.status())
+		}
+	}
+
+	return result, nil
+}
+
+// ErrJobNotFound is returned when a dead letter doesn't exist.
+var ErrJobNotFound = errors.New("download: job not found")
+
+func (d *Downloader) loadDeadLetter(ctx context.Context, id string) (*Job, error) {
+	jobs, err := d.loadJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, j := range jobs {
+		if j.ID == id && j.State == JobFailed {
+			return j, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+}
+
+// RetryDeadLetter gives a dead letter a fresh set of attempts.
+func (d *Downloader) RetryDeadLetter(ctx context.Context, id string) error {
+	j, err := d.loadDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	d.Fetch(j.Request)
+	return nil
+}
+
+// DeleteDeadLetter forgets about a dead letter.
+func (d *Downloader) DeleteDeadLetter(ctx context.Context, id string) error {
+	j, err := d.loadDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return d.deleteJob(ctx, j)
+}
@@ -0,0 +1,38 @@
+package download
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseHostLimits parses per-host concurrency limits in the form `host=n,host=n`, such as
+// `civitai.com=1,registry.ollama.ai=4`. An empty string means no limits.
+func ParseHostLimits(s string) (map[string]int, error) {
+	result := map[string]int{}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		host, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("can't parse host limit %q: want host=n", entry)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil {
+			return nil, fmt.Errorf("can't parse limit for %s: %w", host, err)
+		}
+
+		if n < 1 {
+			return nil, fmt.Errorf("limit for %s must be at least 1, got %d", host, n)
+		}
+
+		result[strings.TrimSpace(host)] = n
+	}
+
+	return result, nil
+}
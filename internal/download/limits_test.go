@@ -0,0 +1,72 @@
+package download
+
+import (
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+func TestParseHostLimits(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		input   string
+		want    map[string]int
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: map[string]int{}},
+		{name: "one", input: "civitai.com=1", want: map[string]int{"civitai.com": 1}},
+		{name: "many", input: "civitai.com=1, registry.ollama.ai=4", want: map[string]int{"civitai.com": 1, "registry.ollama.ai": 4}},
+		{name: "no limit", input: "civitai.com", wantErr: true},
+		{name: "not a number", input: "civitai.com=lots", wantErr: true},
+		{name: "zero", input: "civitai.com=0", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHostLimits(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wanted error: %v, got: %v", tt.wantErr, err)
+			}
+
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostLimits(t *testing.T) {
+	d := New(store.NewMemory(), Options{
+		HostLimits: map[string]int{"civitai.com": 1},
+	})
+
+	for _, j := range []*Job{
+		{Request: Request{Key: "a", PullURL: "https://civitai.com/a"}},
+		{Request: Request{Key: "b", PullURL: "https://civitai.com/b"}},
+		{Request: Request{Key: "c", PullURL: "https://registry.ollama.ai/c"}},
+	} {
+		d.enqueue(j)
+	}
+
+	ctx := context.Background()
+
+	first, _ := d.next(ctx)
+	second, _ := d.next(ctx)
+	if first.Key != "a" || second.Key != "c" {
+		t.Fatalf("wanted jobs a and c to start, got %s and %s", first.Key, second.Key)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if j, ok := d.next(waitCtx); ok {
+		t.Fatalf("job %s started while civitai.com was at its limit", j.Key)
+	}
+
+	d.done(first)
+
+	third, _ := d.next(ctx)
+	if third.Key != "b" {
+		t.Fatalf("wanted job b to start, got %s", third.Key)
+	}
+}
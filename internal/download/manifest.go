@@ -1,5 +1,27 @@
 package download
 
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+const (
+	// ManifestMediaType is the content type of manifests that don't say what they are. Manifests
+	// cached before tags were stored as pointers are stored at their tag's key with this content type.
+	ManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// CivitaiModelMediaType is the content type of cached Civitai model metadata.
+	CivitaiModelMediaType = "application/vnd.civitai.model+json"
+)
+
 type Manifest struct {
 	SchemaVersion int      `json:"schemaVersion"`
 	MediaType     string   `json:"mediaType"`
@@ -18,3 +40,83 @@ type Layers struct {
 	MediaType string `json:"mediaType"`
 	Size      int64  `json:"size"`
 }
+
+// Blobs returns every blob a manifest refers to: its config blob followed by its layers.
+func (m Manifest) Blobs() []Layers {
+	var result []Layers
+
+	if m.Config.Digest != "" {
+		result = append(result, Layers{
+			Digest:    m.Config.Digest,
+			MediaType: m.Config.MediaType,
+			Size:      int64(m.Config.Size),
+		})
+	}
+
+	return append(result, m.Layers...)
+}
+
+// Digest returns the sha256 digest of data, in the form used in manifests and blob keys.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// BlobKey returns the key a blob is stored at.
+func BlobKey(digest string) string {
+	return path.Join("blobs", digest)
+}
+
+// LoadManifest reads a cached manifest from the store, following key if it is a tag.
+func LoadManifest(ctx context.Context, s store.Store, key string) (*Manifest, error) {
+	obj, err := OpenManifest(ctx, s, key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(obj.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("can't parse manifest %s: %w", key, err)
+	}
+
+	return &m, nil
+}
+
+// ReadManifest reads the manifest at key, following key if it is a tag, and returns it with its
+// digest.
+func ReadManifest(ctx context.Context, s store.Store, key string) (*store.ObjectInfo, []byte, string, error) {
+	obj, err := OpenManifest(ctx, s, key)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("can't read manifest: %w", err)
+	}
+
+	// Manifests cached before digests were recorded don't have one, so work it out.
+	digest := obj.Metadata[MetadataDigest]
+	if digest == "" {
+		digest = Digest(data)
+	}
+
+	return &obj.ObjectInfo, data, digest, nil
+}
+
+// FullyCached returns true if the config blob and every layer of m are in the store, meaning that
+// the model can be pulled without going upstream.
+func FullyCached(ctx context.Context, s store.Store, m Manifest) (bool, error) {
+	for _, blob := range m.Blobs() {
+		if _, err := s.Stat(ctx, BlobKey(blob.Digest)); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,95 @@
+package download
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// progress is how far along the current attempt at a job is. It is only tracked in memory.
+type progress struct {
+	done    atomic.Int64
+	total   atomic.Int64 // -1 if unknown
+	offset  int64        // bytes that were already done when this attempt started
+	started time.Time
+}
+
+// startProgress resets the progress for a new attempt that begins offset bytes into an object of total bytes.
+func (d *Downloader) startProgress(j *Job, offset, total int64) {
+	d.Lock()
+	defer d.Unlock()
+
+	j.progress.done.Store(offset)
+	j.progress.total.Store(total)
+	j.progress.offset = offset
+	j.progress.started = time.Now()
+}
+
+// countingReader adds everything read through it to a job's progress.
+type countingReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.p.done.Add(int64(n))
+	return n, err
+}
+
+// fillProgress fills in the progress fields of st. d must be locked.
+func (j *Job) fillProgress(st *Status) {
+	if j.State != JobRunning || j.progress.started.IsZero() {
+		return
+	}
+
+	done, total := j.progress.done.Load(), j.progress.total.Load()
+
+	st.BytesDone = done
+	if total >= 0 {
+		st.BytesTotal = total
+	}
+
+	elapsed := time.Since(j.progress.started).Seconds()
+	transferred := done - j.progress.offset
+	if elapsed <= 0 || transferred <= 0 {
+		return
+	}
+
+	st.BytesPerSecond = int64(float64(transferred) / elapsed)
+
+	if total > done && st.BytesPerSecond > 0 {
+		eta := time.Duration(float64(total-done) / float64(st.BytesPerSecond) * float64(time.Second))
+		st.ETA = eta.Round(time.Second).String()
+	}
+}
+
+// Active returns the status of every job that is queued or running, oldest first.
+func (d *Downloader) Active() []Status {
+	d.Lock()
+	defer d.Unlock()
+
+	result := make([]Status, 0, len(d.inFlight))
+	for _, j := range d.inFlight {
+		result = append(result, j.status())
+	}
+
+	slices.SortFunc(result, func(a, b Status) int {
+		return cmp.Compare(a.CreatedAt.UnixNano(), b.CreatedAt.UnixNano())
+	})
+
+	return result
+}
+
+// Downloads returns the status of every queued, running, and failed job.
+func (d *Downloader) Downloads(ctx context.Context) ([]Status, error) {
+	deadLetters, err := d.DeadLetters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(d.Active(), deadLetters...), nil
+}
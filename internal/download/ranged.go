@@ -0,0 +1,197 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+const (
+	// DefaultChunkSize is the default size of each ranged request in a ranged download.
+	DefaultChunkSize = 64 << 20
+
+	// DefaultRangedThreshold is the default size above which objects are downloaded in ranged chunks.
+	DefaultRangedThreshold = 1 << 30
+
+	// minChunkSize is the smallest part most S3 implementations accept in a multipart upload.
+	minChunkSize = 5 << 20
+)
+
+// Upload is the progress of a ranged download. Each chunk of the object is fetched with a ranged
+// request and uploaded as a part of a multipart upload. Upload is saved with its job after every
+// part, so an interrupted download picks up from the last completed part.
+type Upload struct {
+	ID       string       `json:"id"`
+	Size     int64        `json:"size"`
+	PartSize int64        `json:"partSize"`
+	Parts    []store.Part `json:"parts,omitempty"`
+
+	// HashState is the saved state of the checksums after the last completed part.
+	HashState map[string][]byte `json:"hashState,omitempty"`
+}
+
+// done returns the number of bytes already uploaded.
+func (u *Upload) done() int64 {
+	return min(int64(len(u.Parts))*u.PartSize, u.Size)
+}
+
+// wantRanged returns true if a response should be thrown away and downloaded in ranged chunks
+// instead.
+func (d *Downloader) wantRanged(resp *http.Response) bool {
+	if _, ok := d.s.(store.Multipart); !ok {
+		return false
+	}
+
+	return resp.ContentLength > d.rangedThreshold && resp.Header.Get("Accept-Ranges") == "bytes"
+}
+
+// processRanged downloads a job in chunks, starting a new multipart upload for it if it doesn't
+// already have one.
+func (d *Downloader) processRanged(ctx context.Context, lg *slog.Logger, j *Job, size int64, contentDisposition string) error {
+	mp := d.s.(store.Multipart)
+
+	if j.Upload == nil {
+		uploadID, err := mp.CreateMultipart(ctx, j.Key, store.PutOptions{
+			ContentType:        j.MediaType,
+			ContentDisposition: contentDisposition,
+		})
+		if err != nil {
+			return err
+		}
+
+		j.Upload = &Upload{
+			ID:       uploadID,
+			Size:     size,
+			PartSize: d.chunkSize,
+		}
+	}
+
+	u := j.Upload
+	lg = lg.With("uploadID", u.ID, "size", u.Size)
+
+	cs := newChecksummer(checksumsFor(j.Key, j.Checksums))
+	if len(u.Parts) != 0 {
+		lg.Info("resuming ranged download", "offset", u.done())
+		cs.restore(u.HashState)
+	}
+
+	d.startProgress(j, u.done(), u.Size)
+
+	for offset := u.done(); offset < u.Size; offset = u.done() {
+		length := min(u.PartSize, u.Size-offset)
+		number := int32(len(u.Parts) + 1)
+
+		body, err := d.fetchRange(ctx, j, offset, length)
+		if err != nil {
+			return fmt.Errorf("can't fetch part %d: %w", number, err)
+		}
+
+		part, err := mp.UploadPart(ctx, j.Key, u.ID, number, io.TeeReader(body, cs), length)
+		body.Close()
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				lg.Error("multipart upload is gone, starting over", "err", err)
+				j.Upload = nil
+			}
+			return err
+		}
+
+		u.Parts = append(u.Parts, *part)
+		u.HashState = cs.state()
+
+		if err := d.saveJob(ctx, j); err != nil {
+			lg.Error("can't save download progress", "err", err)
+		}
+
+		lg.Debug("uploaded part", "part", number, "offset", offset+length)
+	}
+
+	if err := cs.check(); err != nil {
+		d.abortUpload(ctx, j)
+		return err
+	}
+
+	if err := mp.CompleteMultipart(ctx, j.Key, u.ID, u.Parts); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			j.Upload = nil
+		}
+		return err
+	}
+
+	j.Upload = nil
+	return nil
+}
+
+// abortUpload throws away a job's in-progress multipart upload, if it has one.
+func (d *Downloader) abortUpload(ctx context.Context, j *Job) {
+	if j.Upload == nil {
+		return
+	}
+
+	if mp, ok := d.s.(store.Multipart); ok {
+		if err := mp.AbortMultipart(context.WithoutCancel(ctx), j.Key, j.Upload.ID); err != nil {
+			slog.Error("can't abort multipart upload", "job", j, "err", err)
+		}
+	}
+
+	j.Upload = nil
+}
+
+// fetchRange requests length bytes of a job's object starting at offset.
+func (d *Downloader) fetchRange(ctx context.Context, j *Job, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.PullURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't make request: %w", err)
+	}
+
+	if authorization := d.authorization(j); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if isManifestJob(j.Key) {
+		req.Header.Set("Accept", ManifestAccept)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch from remote: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("wrong status for ranged request: want %d, got %d", http.StatusPartialContent, resp.StatusCode)
+	}
+
+	if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream sent the wrong range: wanted offset %d, got %q", offset, resp.Header.Get("Content-Range"))
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(d.throttle.Reader(ctx, j.host(), countingReader{resp.Body, &j.progress}), length), resp.Body}, nil
+}
+
+// contentRangeStart parses the start offset out of a Content-Range header like `bytes 0-99/1000`.
+func contentRangeStart(header string) (int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, false
+	}
+
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, false
+	}
+
+	result, err := strconv.ParseInt(start, 10, 64)
+	return result, err == nil
+}
@@ -0,0 +1,55 @@
+package download
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy controls how failed downloads are retried.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a job is tried before it is given up on and kept as a dead
+	// letter.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. Each retry after that waits twice as long as
+	// the last, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultRetryPolicy is used for any zero fields in an Options' RetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    30 * time.Minute,
+}
+
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.MaxAttempts <= 0 {
+		rp.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+
+	if rp.BaseDelay <= 0 {
+		rp.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+
+	if rp.MaxDelay <= 0 {
+		rp.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+
+	return rp
+}
+
+// Backoff returns how long to wait before retrying a job that has failed attempts times. Half of
+// the delay is random jitter, so that jobs which failed together don't all retry together.
+func (rp RetryPolicy) Backoff(attempts int) time.Duration {
+	delay := rp.MaxDelay
+	if shift := attempts - 1; shift < 32 {
+		if d := rp.BaseDelay << shift; d > 0 && d < rp.MaxDelay {
+			delay = d
+		}
+	}
+
+	half := delay / 2
+	return half + rand.N(half+1)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package download
+
+import "errors"
+
+// freeSpace isn't supported here, so spooling never checks for space.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
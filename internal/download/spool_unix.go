@@ -0,0 +1,15 @@
+//go:build unix
+
+package download
+
+import "syscall"
+
+// freeSpace returns how many bytes can be written to the filesystem dir is on.
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return st.Bavail * uint64(st.Bsize), nil
+}
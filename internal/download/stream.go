@@ -0,0 +1,275 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// Stream is an upstream response that is being spooled to a temporary file and uploaded into the
+// store while it is served to every client that asked for it. This means a cold object is only
+// downloaded from upstream once, no matter how many clients pull it at the same time.
+//
+// The whole object is spooled, so the spool directory (see Options.SpoolDir) needs as much free
+// space as the biggest objects being streamed at once. Objects that don't fit aren't streamed.
+type Stream struct {
+	Key         string
+	ContentType string
+	Size        int64 // -1 if upstream didn't say
+
+	req   Request       // queued for download if the stream can't be saved
+	ready chan struct{} // closed once the upstream response headers are in
+	err   error         // set before ready is closed if upstream failed
+
+	spool *os.File
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	written int64
+	done    bool
+	copyErr error
+	refs    int
+}
+
+// StreamThrough returns a reader for req.Key that follows the in-progress upstream stream for it,
+// starting one by calling fetch if there isn't one already. fetch is called with a context that
+// is not canceled when the client that triggered it goes away, as other clients may be attached.
+// If the streamed object can't be saved, req is queued for download instead.
+//
+// If upstream doesn't return 200 or there isn't room to spool the object, an error is returned and
+// the caller should fall back to proxying the request.
+func (d *Downloader) StreamThrough(ctx context.Context, req Request, fetch func(context.Context) (*http.Response, error)) (*Stream, io.ReadCloser, error) {
+	d.Lock()
+	st, ok := d.streams[req.Key]
+	if !ok {
+		st = &Stream{
+			Key:   req.Key,
+			req:   req,
+			ready: make(chan struct{}),
+			refs:  1, // released by d.stream once the upload is done
+		}
+		st.cond = sync.NewCond(&st.lock)
+		d.streams[req.Key] = st
+		go d.stream(context.WithoutCancel(ctx), st, fetch)
+	}
+	st.acquire()
+	d.Unlock()
+
+	select {
+	case <-ctx.Done():
+		st.release()
+		return nil, nil, ctx.Err()
+	case <-st.ready:
+	}
+
+	if st.err != nil {
+		st.release()
+		return nil, nil, st.err
+	}
+
+	return st, st.newReader(ctx), nil
+}
+
+// streaming returns true if key is currently being streamed through from upstream.
+func (d *Downloader) streaming(key string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	_, found := d.streams[key]
+	return found
+}
+
+func (d *Downloader) stream(ctx context.Context, st *Stream, fetch func(context.Context) (*http.Response, error)) {
+	lg := slog.With(
+		"component", "downloader",
+		"stream", st.Key,
+	)
+
+	defer st.release()
+	defer func() {
+		d.Lock()
+		delete(d.streams, st.Key)
+		d.Unlock()
+	}()
+
+	resp, err := fetch(ctx)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("wrong status from upstream: want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if err == nil {
+		st.spool, err = d.createSpool(resp.ContentLength)
+		if err != nil {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		lg.Error("can't start stream", "err", err)
+		st.err = err
+		close(st.ready)
+		return
+	}
+	defer resp.Body.Close()
+
+	st.ContentType = resp.Header.Get("Content-Type")
+	st.Size = resp.ContentLength
+	close(st.ready)
+
+	lg.Info("streaming from upstream", "size", st.Size)
+
+	st.acquire()
+	upload := st.newReader(ctx)
+	uploadDone := make(chan error, 1)
+	go func() {
+		defer upload.Close()
+
+		// Clients are sent whatever upstream sends, but only verified blobs make it into the store.
+		var body io.Reader = upload
+		if sums := checksumsFor(st.Key, Checksums{}); !sums.empty() {
+			body = newVerifier(upload, st.Size, sums)
+		}
+
+		uploadDone <- d.s.Put(ctx, st.Key, body, st.Size, store.PutOptions{
+			ContentType:        st.ContentType,
+			ContentDisposition: resp.Header.Get("Content-Disposition"),
+		})
+	}()
+
+	_, err = io.Copy(st, resp.Body)
+	st.finish(err)
+	if err != nil {
+		lg.Error("can't read from upstream", "err", err)
+	}
+
+	if err := <-uploadDone; err != nil {
+		lg.Error("can't put streamed object, queueing it for download", "err", err)
+		d.Fetch(st.req)
+		return
+	}
+
+	lg.Info("cached streamed object")
+}
+
+// createSpool creates the file a stream of size bytes (-1 if unknown) is spooled to, if there is
+// room for it.
+func (d *Downloader) createSpool(size int64) (*os.File, error) {
+	if size > 0 {
+		free, err := freeSpace(d.spoolDir)
+		if err == nil && free < uint64(size) {
+			return nil, fmt.Errorf("can't spool %d bytes to %s, only %d bytes free", size, d.spoolDir, free)
+		}
+	}
+
+	return os.CreateTemp(d.spoolDir, "yukari-stream-*")
+}
+
+// Write appends upstream data to the spool file and wakes up any readers waiting for it.
+func (st *Stream) Write(p []byte) (int, error) {
+	n, err := st.spool.Write(p)
+
+	st.lock.Lock()
+	st.written += int64(n)
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	return n, err
+}
+
+func (st *Stream) finish(err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.done = true
+	st.copyErr = err
+	st.cond.Broadcast()
+}
+
+func (st *Stream) acquire() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.refs++
+}
+
+func (st *Stream) release() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.refs--
+	if st.refs == 0 && st.spool != nil {
+		st.spool.Close()
+		os.Remove(st.spool.Name())
+	}
+}
+
+// newReader returns a reader for the stream. The caller must already hold a reference, which is
+// released when the reader is closed.
+func (st *Stream) newReader(ctx context.Context) *streamReader {
+	sr := &streamReader{st: st, ctx: ctx}
+	sr.stop = context.AfterFunc(ctx, func() {
+		st.lock.Lock()
+		st.cond.Broadcast()
+		st.lock.Unlock()
+	})
+	return sr
+}
+
+type streamReader struct {
+	st     *Stream
+	ctx    context.Context
+	offset int64
+	stop   func() bool
+	closed bool
+}
+
+// Read blocks until there is more data in the spool file than has been read so far, or the
+// upstream response is finished.
+func (sr *streamReader) Read(p []byte) (int, error) {
+	st := sr.st
+
+	st.lock.Lock()
+	for sr.offset >= st.written && !st.done && sr.ctx.Err() == nil {
+		st.cond.Wait()
+	}
+	written, done, copyErr := st.written, st.done, st.copyErr
+	st.lock.Unlock()
+
+	if err := sr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if sr.offset >= written && done {
+		if copyErr != nil {
+			return 0, copyErr
+		}
+		return 0, io.EOF
+	}
+
+	if avail := written - sr.offset; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+
+	n, err := st.spool.ReadAt(p, sr.offset)
+	sr.offset += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (sr *streamReader) Close() error {
+	if sr.closed {
+		return nil
+	}
+
+	sr.closed = true
+	sr.stop()
+	sr.st.release()
+	return nil
+}
@@ -0,0 +1,182 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+const (
+	// TagMediaType is the content type of tag pointer objects.
+	TagMediaType = "application/vnd.yukari.tag+json"
+
+	// maxTagHistory is how many manifests a tag remembers pointing at.
+	maxTagHistory = 100
+)
+
+// ErrNotTag is returned by LoadTag for objects that aren't tag pointers, such as manifests cached
+// before manifests were stored by digest.
+var ErrNotTag = errors.New("download: object is not a tag")
+
+// Tag is what is stored at a tag's key (such as `v2/library/llama3/manifests/latest`). The manifest
+// itself is stored by digest at ManifestKey, so that it can still be pulled by digest after the tag
+// moves on.
+type Tag struct {
+	Digest    string     `json:"digest"`
+	MediaType string     `json:"mediaType"`
+	History   []TagEntry `json:"history"` // oldest first
+}
+
+// TagEntry is a manifest a tag pointed at, and when it was first seen there.
+type TagEntry struct {
+	Digest string    `json:"digest"`
+	Seen   time.Time `json:"seen"`
+}
+
+// ManifestKey returns the key a manifest is stored at.
+func ManifestKey(digest string) string {
+	return path.Join("manifests", digest)
+}
+
+// IsManifestKey returns true if key is the content-addressed key of a manifest.
+func IsManifestKey(key string) bool {
+	return strings.HasPrefix(key, "manifests/")
+}
+
+// isManifestJob returns true if key is where a manifest is stored, either by tag or by digest.
+func isManifestJob(key string) bool {
+	return IsManifestKey(key) || strings.Contains(key, "/manifests/")
+}
+
+// move points t at digest, recording it in the history if the tag has moved.
+func (t *Tag) move(digest, mediaType string, now time.Time) {
+	t.MediaType = mediaType
+
+	if t.Digest == digest && len(t.History) != 0 {
+		return
+	}
+
+	t.Digest = digest
+	t.History = append(t.History, TagEntry{Digest: digest, Seen: now})
+	if len(t.History) > maxTagHistory {
+		t.History = t.History[len(t.History)-maxTagHistory:]
+	}
+}
+
+// LoadTag reads the tag pointer at key, or returns ErrNotTag.
+func LoadTag(ctx context.Context, s store.Store, key string) (*Tag, error) {
+	obj, err := s.Get(ctx, key, store.Range{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	if obj.ContentType != TagMediaType {
+		return nil, ErrNotTag
+	}
+
+	var t Tag
+	if err := json.NewDecoder(obj.Body).Decode(&t); err != nil {
+		return nil, fmt.Errorf("can't parse tag %s: %w", key, err)
+	}
+
+	return &t, nil
+}
+
+// OpenManifest opens the manifest at key, following it to the manifest's digest if key is a tag.
+func OpenManifest(ctx context.Context, s store.Store, key string) (*store.Object, error) {
+	obj, err := s.Get(ctx, key, store.Range{})
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.ContentType != TagMediaType {
+		return obj, nil
+	}
+	defer obj.Body.Close()
+
+	var t Tag
+	if err := json.NewDecoder(obj.Body).Decode(&t); err != nil {
+		return nil, fmt.Errorf("can't parse tag %s: %w", key, err)
+	}
+
+	return s.Get(ctx, ManifestKey(t.Digest), store.Range{})
+}
+
+// putManifest stores a manifest by its digest, and points the job's tag at it unless the manifest
+// was requested by digest.
+func (d *Downloader) putManifest(ctx context.Context, j *Job, data []byte, digest string) error {
+	mediaType := j.MediaType
+	if mediaType == "" {
+		mediaType = ManifestMediaType
+	}
+
+	if IsManifestKey(j.Key) && j.Key != ManifestKey(digest) {
+		return fmt.Errorf("manifest digest mismatch: want %s, got %s", path.Base(j.Key), digest)
+	}
+
+	if err := d.s.Put(ctx, ManifestKey(digest), bytes.NewReader(data), int64(len(data)), store.PutOptions{
+		ContentType: mediaType,
+		Metadata: map[string]string{
+			MetadataDigest: digest,
+		},
+	}); err != nil {
+		return fmt.Errorf("can't put manifest: %w", err)
+	}
+
+	if IsManifestKey(j.Key) {
+		return nil
+	}
+
+	if pinned, ok := d.pins.Pinned(j.Key); ok && pinned != digest {
+		slog.Info("tag is pinned, not moving it", "key", j.Key, "pinned", pinned, "upstream", digest)
+		return nil
+	}
+
+	return PutTag(ctx, d.s, j.Key, digest, mediaType, j.PullURL)
+}
+
+// PutTag points the tag at key to a manifest, recording it in the tag's history if the tag moved.
+// pullURL is where the tag is refreshed from, which is worked out from the key if it is empty.
+func PutTag(ctx context.Context, s store.Store, key, digest, mediaType, pullURL string) error {
+	t, err := LoadTag(ctx, s, key)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) && !errors.Is(err, ErrNotTag) {
+			return fmt.Errorf("can't load tag: %w", err)
+		}
+		t = &Tag{}
+	}
+
+	t.move(digest, mediaType, time.Now())
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("can't encode tag: %w", err)
+	}
+
+	metadata := map[string]string{
+		MetadataDigest: digest,
+	}
+	if pullURL != "" {
+		metadata[MetadataPullURL] = pullURL
+	}
+
+	// The tag is written even if it didn't move, so that its last modified time says when it was
+	// last checked.
+	if err := s.Put(ctx, key, bytes.NewReader(data), int64(len(data)), store.PutOptions{
+		ContentType: TagMediaType,
+		Metadata:    metadata,
+	}); err != nil {
+		return fmt.Errorf("can't put tag: %w", err)
+	}
+
+	return nil
+}
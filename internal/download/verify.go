@@ -0,0 +1,185 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// ErrChecksumMismatch is returned when a download doesn't match its expected checksums.
+var ErrChecksumMismatch = errors.New("download: checksum mismatch")
+
+// Checksums are the expected checksums of a download as hex strings. Empty fields are not checked.
+//
+// Objects stored under `blobs/sha256:<digest>` are always checked against their digest, even if
+// SHA256 is not set.
+type Checksums struct {
+	SHA256 string `json:"sha256,omitempty"`
+	BLAKE3 string `json:"blake3,omitempty"`
+	CRC32  string `json:"crc32,omitempty"`
+}
+
+// checksumsFor returns the checksums to verify the download of key against.
+func checksumsFor(key string, sums Checksums) Checksums {
+	if digest, ok := strings.CutPrefix(path.Base(key), "sha256:"); ok && strings.HasPrefix(key, "blobs/") {
+		sums.SHA256 = digest
+	}
+
+	return sums
+}
+
+func (c Checksums) empty() bool {
+	return c == Checksums{}
+}
+
+type namedHash struct {
+	name string
+	want string
+	hash.Hash
+}
+
+// checksummer hashes everything written to it with every algorithm there is an expected checksum
+// for.
+type checksummer struct {
+	hashes []namedHash
+}
+
+func newChecksummer(sums Checksums) *checksummer {
+	c := &checksummer{}
+
+	if sums.SHA256 != "" {
+		c.hashes = append(c.hashes, namedHash{"sha256", sums.SHA256, sha256.New()})
+	}
+
+	if sums.BLAKE3 != "" {
+		c.hashes = append(c.hashes, namedHash{"blake3", sums.BLAKE3, blake3.New(32, nil)})
+	}
+
+	if sums.CRC32 != "" {
+		c.hashes = append(c.hashes, namedHash{"crc32", sums.CRC32, crc32.NewIEEE()})
+	}
+
+	return c
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	for _, h := range c.hashes {
+		h.Write(p)
+	}
+
+	return len(p), nil
+}
+
+func (c *checksummer) check() error {
+	for _, h := range c.hashes {
+		got := hex.EncodeToString(h.Sum(nil))
+		if !strings.EqualFold(got, h.want) {
+			return fmt.Errorf("%w: wanted %s %s, got %s", ErrChecksumMismatch, h.name, strings.ToLower(h.want), got)
+		}
+	}
+
+	return nil
+}
+
+// state returns the intermediate state of every hash that supports saving it, so hashing can be
+// picked back up after a restart.
+func (c *checksummer) state() map[string][]byte {
+	result := map[string][]byte{}
+
+	for _, h := range c.hashes {
+		if m, ok := h.Hash.(encoding.BinaryMarshaler); ok {
+			if data, err := m.MarshalBinary(); err == nil {
+				result[h.name] = data
+			}
+		}
+	}
+
+	return result
+}
+
+// restore loads hash states saved with state. Hashes that couldn't be saved (BLAKE3) can't be
+// checked after a restart, so they are dropped and only the others are verified.
+func (c *checksummer) restore(state map[string][]byte) {
+	var kept []namedHash
+
+	for _, h := range c.hashes {
+		u, ok := h.Hash.(encoding.BinaryUnmarshaler)
+		if !ok {
+			slog.Warn("can't resume hash, not checking it", "hash", h.name)
+			continue
+		}
+
+		if err := u.UnmarshalBinary(state[h.name]); err != nil {
+			slog.Warn("can't resume hash, not checking it", "hash", h.name, "err", err)
+			continue
+		}
+
+		kept = append(kept, h)
+	}
+
+	c.hashes = kept
+}
+
+// verifier hashes everything read through it and fails the read that would complete the stream if
+// the result doesn't match what was expected. Failing that read (instead of a read after it) means
+// the store never sees a complete body, so a bad download can't be committed.
+type verifier struct {
+	r    io.Reader
+	size int64 // -1 if unknown
+	read int64
+	cs   *checksummer
+	err  error
+	done bool
+}
+
+func newVerifier(r io.Reader, size int64, sums Checksums) *verifier {
+	return &verifier{r: r, size: size, cs: newChecksummer(sums)}
+}
+
+// NewVerifier returns a reader that reads size bytes (or, if size is -1, everything) from r and
+// fails with ErrChecksumMismatch instead of finishing if they don't match sums. Stores never commit
+// a body that fails to read, so this keeps bad objects out of the store entirely.
+func NewVerifier(r io.Reader, size int64, sums Checksums) io.Reader {
+	return newVerifier(r, size, sums)
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	if v.done {
+		if v.err != nil {
+			return 0, v.err
+		}
+		return v.r.Read(p)
+	}
+
+	n, err := v.r.Read(p)
+	v.read += int64(n)
+	v.cs.Write(p[:n])
+
+	if err == io.EOF || (v.size >= 0 && v.read >= v.size) {
+		v.done = true
+		v.err = v.check()
+		if v.err != nil {
+			return 0, v.err
+		}
+	}
+
+	return n, err
+}
+
+func (v *verifier) check() error {
+	if v.size >= 0 && v.read != v.size {
+		return fmt.Errorf("%w: wanted %d bytes, got %d", ErrChecksumMismatch, v.size, v.read)
+	}
+
+	return v.cs.check()
+}
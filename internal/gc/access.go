@@ -0,0 +1,147 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+const (
+	// accessKey is where the access log is kept.
+	accessKey = "yukari/access"
+
+	// accessFlushInterval is how often the access log is written to the store.
+	accessFlushInterval = time.Minute
+)
+
+// Tracker records when objects were last served to a client, so that the least recently used models
+// can be evicted first. The access log is kept in memory and written to the store every
+// accessFlushInterval. A nil *Tracker doesn't record anything.
+type Tracker struct {
+	s store.Store
+
+	lock  sync.Mutex
+	seen  map[string]time.Time
+	dirty bool
+}
+
+// NewTracker loads the access log from s.
+func NewTracker(ctx context.Context, s store.Store) (*Tracker, error) {
+	t := &Tracker{
+		s:    s,
+		seen: map[string]time.Time{},
+	}
+
+	obj, err := s.Get(ctx, accessKey, store.Range{})
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return t, nil
+	case err != nil:
+		return nil, fmt.Errorf("can't load access log: %w", err)
+	}
+	defer obj.Body.Close()
+
+	if err := json.NewDecoder(obj.Body).Decode(&t.seen); err != nil {
+		return nil, fmt.Errorf("can't parse access log: %w", err)
+	}
+
+	return t, nil
+}
+
+// Touch records that the object at key was just served.
+func (t *Tracker) Touch(key string) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.seen[key] = time.Now()
+	t.dirty = true
+}
+
+// LastAccess returns when the object at key was last served, if it has been.
+func (t *Tracker) LastAccess(key string) (time.Time, bool) {
+	if t == nil {
+		return time.Time{}, false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	when, ok := t.seen[key]
+	return when, ok
+}
+
+// Forget removes deleted objects from the access log.
+func (t *Tracker) Forget(keys ...string) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, key := range keys {
+		delete(t.seen, key)
+	}
+	t.dirty = true
+}
+
+// Work writes the access log to the store every accessFlushInterval until ctx is done.
+func (t *Tracker) Work(ctx context.Context) {
+	tick := time.NewTicker(accessFlushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Use a fresh context so that the last accesses are saved on the way out.
+			if err := t.Flush(context.Background()); err != nil {
+				slog.Error("can't save access log", "err", err)
+			}
+			return
+		case <-tick.C:
+			if err := t.Flush(ctx); err != nil {
+				slog.Error("can't save access log", "err", err)
+			}
+		}
+	}
+}
+
+// Flush writes the access log to the store if it has changed.
+func (t *Tracker) Flush(ctx context.Context) error {
+	t.lock.Lock()
+	if !t.dirty {
+		t.lock.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(t.seen)
+	t.dirty = false
+	t.lock.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("can't encode access log: %w", err)
+	}
+
+	if err := t.s.Put(ctx, accessKey, bytes.NewReader(data), int64(len(data)), store.PutOptions{
+		ContentType: "application/json",
+	}); err != nil {
+		t.lock.Lock()
+		t.dirty = true
+		t.lock.Unlock()
+
+		return fmt.Errorf("can't save access log: %w", err)
+	}
+
+	return nil
+}
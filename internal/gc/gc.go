@@ -0,0 +1,390 @@
+// Package gc keeps the cache under a size budget by evicting the models that were used least
+// recently.
+//
+// Models are found by walking everything that refers to blobs: cached Ollama manifests (along with
+// the tags that point at them) and Civitai model metadata. Blobs shared between models are only
+// deleted when the last model using them is evicted. Pinned models are never evicted.
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/civitai"
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// Collector evicts models when the store is bigger than its budget.
+type Collector struct {
+	s      store.Store
+	access *Tracker
+	pins   *pin.Set
+	budget int64
+	dryRun bool
+
+	lock sync.Mutex // held while collecting, so that only one collection runs at a time
+	last *Report
+}
+
+// New creates a Collector that keeps s under budget bytes. If dryRun is set, Work reports what it
+// would evict without deleting anything.
+func New(s store.Store, access *Tracker, pins *pin.Set, budget int64, dryRun bool) *Collector {
+	return &Collector{
+		s:      s,
+		access: access,
+		pins:   pins,
+		budget: budget,
+		dryRun: dryRun,
+	}
+}
+
+// Report is what a collection did (or would have done, for dry runs).
+type Report struct {
+	Time    time.Time  `json:"time"`
+	DryRun  bool       `json:"dryRun"`
+	Budget  int64      `json:"budget"`
+	Size    int64      `json:"size"` // before anything was evicted
+	Freed   int64      `json:"freed"`
+	Evicted []Eviction `json:"evicted"`
+}
+
+// Eviction is a model that was evicted.
+type Eviction struct {
+	Model      string    `json:"model"`
+	LastAccess time.Time `json:"lastAccess"`
+	Bytes      int64     `json:"bytes"`
+	Keys       []string  `json:"keys"`
+}
+
+// model is everything that is deleted when a model is evicted.
+type model struct {
+	name       string
+	tags       []string // that point at the model's manifest
+	keys       []string // manifests, tags, and metadata
+	blobs      []string
+	lastAccess time.Time
+	pinned     bool
+	root       bool // a tag, pin, or Civitai model refers to it, rather than just its digest
+}
+
+// Work collects every period until ctx is done.
+func (c *Collector) Work(ctx context.Context, period time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("returning from gc work thread")
+			return
+		default:
+			r, err := c.Collect(ctx, c.dryRun)
+			if err != nil {
+				slog.Error("can't collect garbage", "err", err)
+			} else if len(r.Evicted) != 0 {
+				slog.Info("evicted models", "dryRun", r.DryRun, "count", len(r.Evicted), "freed", r.Freed, "size", r.Size, "budget", r.Budget)
+			}
+
+			time.Sleep(period)
+		}
+	}
+}
+
+// LastReport returns the report from the last collection, or nil if there hasn't been one.
+func (c *Collector) LastReport() *Report {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.last
+}
+
+// Collect evicts the least recently used models until the store fits in the budget. If dryRun is
+// set (or the Collector was made for dry runs), nothing is deleted.
+func (c *Collector) Collect(ctx context.Context, dryRun bool) (*Report, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	dryRun = dryRun || c.dryRun
+
+	objects, err := c.s.List(ctx, store.Query{})
+	if err != nil {
+		return nil, fmt.Errorf("can't list objects: %w", err)
+	}
+
+	infos := map[string]store.ObjectInfo{}
+	r := &Report{
+		Time:    time.Now(),
+		DryRun:  dryRun,
+		Budget:  c.budget,
+		Evicted: []Eviction{},
+	}
+
+	for _, obj := range objects {
+		infos[obj.Key] = obj
+		r.Size += obj.Size
+	}
+
+	if r.Size > c.budget {
+		if err := c.evict(ctx, r, infos); err != nil {
+			return nil, err
+		}
+	}
+
+	c.last = r
+	return r, nil
+}
+
+func (c *Collector) evict(ctx context.Context, r *Report, infos map[string]store.ObjectInfo) error {
+	models, err := findModels(ctx, c.s, c.pins)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range models {
+		m.lastAccess = c.lastAccess(m, infos)
+	}
+
+	refs := map[string]int{}
+	for _, m := range models {
+		for _, blob := range m.blobs {
+			refs[blob]++
+		}
+	}
+
+	slices.SortFunc(models, func(a, b *model) int {
+		return a.lastAccess.Compare(b.lastAccess)
+	})
+
+	for _, m := range models {
+		if r.Size-r.Freed <= c.budget {
+			break
+		}
+
+		if m.pinned {
+			continue
+		}
+
+		keys := m.keys
+		for _, blob := range m.blobs {
+			refs[blob]--
+			if refs[blob] == 0 {
+				keys = append(keys, blob)
+			}
+		}
+
+		ev := Eviction{
+			Model:      m.name,
+			LastAccess: m.lastAccess,
+			Keys:       []string{},
+		}
+
+		for _, key := range keys {
+			info, ok := infos[key]
+			if !ok {
+				continue
+			}
+
+			if !r.DryRun {
+				if err := c.s.Delete(ctx, key); err != nil {
+					return fmt.Errorf("can't delete %s: %w", key, err)
+				}
+			}
+
+			ev.Bytes += info.Size
+			ev.Keys = append(ev.Keys, key)
+		}
+
+		if !r.DryRun {
+			c.access.Forget(ev.Keys...)
+		}
+
+		r.Freed += ev.Bytes
+		r.Evicted = append(r.Evicted, ev)
+	}
+
+	return nil
+}
+
+// findModels finds every model in the store.
+func findModels(ctx context.Context, s store.Store, pins *pin.Set) ([]*model, error) {
+	var result []*model
+	byDigest := map[string]*model{}
+
+	manifests, err := s.List(ctx, store.Query{Prefix: "manifests/"})
+	if err != nil {
+		return nil, fmt.Errorf("can't list manifests: %w", err)
+	}
+
+	for _, obj := range manifests {
+		m, err := manifestModel(ctx, s, obj.Key, strings.TrimPrefix(obj.Key, "manifests/"))
+		if err != nil {
+			return nil, err
+		}
+
+		byDigest[m.name] = m
+		result = append(result, m)
+	}
+
+	tags, err := s.List(ctx, store.Query{Prefix: "v2/", ContentType: download.TagMediaType})
+	if err != nil {
+		return nil, fmt.Errorf("can't list tags: %w", err)
+	}
+
+	for _, obj := range tags {
+		t, err := download.LoadTag(ctx, s, obj.Key)
+		if err != nil {
+			return nil, fmt.Errorf("can't load tag %s: %w", obj.Key, err)
+		}
+
+		// Tags are evicted with the manifest they point at, and named after it.
+		m, ok := byDigest[t.Digest]
+		if !ok {
+			m = &model{name: t.Digest}
+			byDigest[t.Digest] = m
+			result = append(result, m)
+		}
+
+		m.tags = append(m.tags, tagRef(obj.Key))
+		m.keys = append(m.keys, obj.Key)
+		m.pinned = m.pinned || pinned(pins, obj.Key)
+		m.root = true
+	}
+
+	// Legacy manifests are stored at their tag's key, and are their own model.
+	legacy, err := s.List(ctx, store.Query{Prefix: "v2/", ContentType: download.ManifestMediaType})
+	if err != nil {
+		return nil, fmt.Errorf("can't list manifests: %w", err)
+	}
+
+	for _, obj := range legacy {
+		m, err := manifestModel(ctx, s, obj.Key, tagRef(obj.Key))
+		if err != nil {
+			return nil, err
+		}
+
+		m.pinned = pinned(pins, obj.Key)
+		m.root = true
+		result = append(result, m)
+	}
+
+	for _, digest := range pins.Digests() {
+		if m, ok := byDigest[digest]; ok {
+			m.pinned = true
+			m.root = true
+		}
+	}
+
+	civitaiModels, err := s.List(ctx, store.Query{Prefix: "civitai/models/", ContentType: download.CivitaiModelMediaType})
+	if err != nil {
+		return nil, fmt.Errorf("can't list civitai models: %w", err)
+	}
+
+	for _, obj := range civitaiModels {
+		m, err := civitaiModel(ctx, s, obj.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		m.root = true
+
+		result = append(result, m)
+	}
+
+	for _, m := range result {
+		if len(m.tags) != 0 {
+			m.name = strings.Join(m.tags, ", ")
+		}
+
+		slices.Sort(m.blobs)
+		m.blobs = slices.Compact(m.blobs)
+	}
+
+	return result, nil
+}
+
+func manifestModel(ctx context.Context, s store.Store, key, name string) (*model, error) {
+	mf, err := download.LoadManifest(ctx, s, key)
+	if err != nil {
+		return nil, fmt.Errorf("can't load manifest %s: %w", key, err)
+	}
+
+	m := &model{
+		name: name,
+		keys: []string{key},
+	}
+
+	for _, blob := range mf.Blobs() {
+		m.blobs = append(m.blobs, download.BlobKey(blob.Digest))
+	}
+
+	return m, nil
+}
+
+// civitaiModel returns a Civitai model. Its metadata is evicted with it, so that the Civitai
+// invalidator doesn't download it again.
+func civitaiModel(ctx context.Context, s store.Store, key string) (*model, error) {
+	obj, err := s.Get(ctx, key, store.Range{})
+	if err != nil {
+		return nil, fmt.Errorf("can't get civitai model %s: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	var info civitai.ModelResponse
+	if err := json.NewDecoder(obj.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("can't parse civitai model %s: %w", key, err)
+	}
+
+	m := &model{
+		name: "civitai:" + info.Name,
+		keys: []string{key},
+	}
+
+	for _, version := range info.ModelVersions {
+		m.keys = append(m.keys, fmt.Sprintf("civitai/model-versions/%d", version.ID))
+
+		for _, file := range version.Files {
+			m.blobs = append(m.blobs, download.BlobKey("sha256:"+strings.ToLower(file.Hashes.Sha256)))
+		}
+	}
+
+	return m, nil
+}
+
+func pinned(pins *pin.Set, key string) bool {
+	_, ok := pins.Pinned(key)
+	return ok
+}
+
+// lastAccess returns when any part of a model was last served. Models that haven't been served
+// since access times were recorded fall back to when they were cached.
+func (c *Collector) lastAccess(m *model, infos map[string]store.ObjectInfo) time.Time {
+	var result time.Time
+
+	for _, key := range slices.Concat(m.keys, m.blobs) {
+		if when, ok := c.access.LastAccess(key); ok && when.After(result) {
+			result = when
+		}
+	}
+
+	if result.IsZero() && len(m.keys) != 0 {
+		result = infos[m.keys[0]].LastModified
+	}
+
+	return result
+}
+
+// tagRef turns a tag key (such as `v2/library/llama3/manifests/latest`) into the reference clients
+// pull (such as `library/llama3:latest`).
+func tagRef(key string) string {
+	name, tag, ok := strings.Cut(strings.TrimPrefix(key, "v2/"), "/manifests/")
+	if !ok {
+		return key
+	}
+
+	return name + ":" + tag
+}
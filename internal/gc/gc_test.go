@@ -0,0 +1,237 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// putModel caches a model with a layer for every blob, returning the digest of its manifest.
+func putModel(t *testing.T, s store.Store, name string, blobs ...string) string {
+	t.Helper()
+	ctx := context.Background()
+
+	var layers []string
+	for _, blob := range blobs {
+		digest := download.Digest([]byte(blob))
+		layers = append(layers, fmt.Sprintf(`{"digest":%q,"size":%d}`, digest, len(blob)))
+
+		if err := s.Put(ctx, download.BlobKey(digest), strings.NewReader(blob), int64(len(blob)), store.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest := []byte(`{"schemaVersion":2,"layers":[` + strings.Join(layers, ",") + `]}`)
+	digest := download.Digest(manifest)
+
+	if err := s.Put(ctx, download.ManifestKey(digest), bytes.NewReader(manifest), int64(len(manifest)), store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := json.Marshal(download.Tag{Digest: digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(ctx, pin.TagKey(name, "latest"), bytes.NewReader(tag), int64(len(tag)), store.PutOptions{ContentType: download.TagMediaType}); err != nil {
+		t.Fatal(err)
+	}
+
+	return digest
+}
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	shared := strings.Repeat("s", 100)
+	layer := func(c string) string { return strings.Repeat(c, 1000) }
+
+	putModel(t, s, "library/old", shared, layer("a"))
+	putModel(t, s, "library/mid", shared, layer("b"))
+	putModel(t, s, "library/new", layer("c"))
+	pinnedDigest := putModel(t, s, "library/pinned", layer("d"))
+
+	access, err := NewTracker(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for name, ago := range map[string]time.Duration{
+		"library/old":    3 * time.Hour,
+		"library/mid":    2 * time.Hour,
+		"library/new":    time.Minute,
+		"library/pinned": 5 * time.Hour,
+	} {
+		access.seen[pin.TagKey(name, "latest")] = now.Add(-ago)
+	}
+
+	pins, err := pin.Load(ctx, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pins.Add(ctx, pin.Pin{Name: "library/pinned", Tag: "latest", Digest: pinnedDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(s, access, pins, 3000, false)
+
+	dry, err := c.Collect(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Stat(ctx, pin.TagKey("library/old", "latest")); err != nil {
+		t.Fatalf("dry run deleted something: %v", err)
+	}
+
+	r, err := c.Collect(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var evicted []string
+	for _, ev := range r.Evicted {
+		evicted = append(evicted, ev.Model)
+	}
+
+	if got, want := strings.Join(evicted, " "), "library/old:latest library/mid:latest"; got != want {
+		t.Fatalf("wrong models evicted: got %q, want %q", got, want)
+	}
+
+	if dry.Freed != r.Freed {
+		t.Fatalf("dry run freed %d bytes, real run freed %d", dry.Freed, r.Freed)
+	}
+
+	for blob, want := range map[string]bool{
+		shared:     false,
+		layer("a"): false,
+		layer("b"): false,
+		layer("c"): true,
+		layer("d"): true,
+	} {
+		_, err := s.Stat(ctx, download.BlobKey(download.Digest([]byte(blob))))
+		if got := err == nil; got != want {
+			t.Errorf("blob %c...: wanted kept: %v, got %v", blob[0], want, got)
+		}
+	}
+}
+
+func TestTrackerFlush(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	access, err := NewTracker(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access.Touch("blobs/sha256:abcd")
+	if err := access.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	access, err = NewTracker(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := access.LastAccess("blobs/sha256:abcd"); !ok {
+		t.Fatal("access log wasn't saved")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	putModel(t, s, "library/llama3", "i am a model layer")
+
+	orphan := download.BlobKey(download.Digest([]byte("old layer")))
+	if err := s.Put(ctx, orphan, strings.NewReader("old layer"), -1, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name        string
+		grace       time.Duration
+		dryRun      bool
+		wantDeleted bool
+	}{
+		{name: "dry run", dryRun: true},
+		{name: "grace period", grace: time.Hour},
+		{name: "delete", wantDeleted: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewSweeper(s, nil, nil, tt.grace).Sweep(ctx, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Reachable != 1 {
+				t.Fatalf("wanted 1 reachable blob, got %d", r.Reachable)
+			}
+
+			if len(r.Orphans) != 1 || r.Orphans[0].Key != orphan {
+				t.Fatalf("wanted %s to be the only orphan, got %+v", orphan, r.Orphans)
+			}
+
+			_, err = s.Stat(ctx, orphan)
+			if deleted := err != nil; deleted != tt.wantDeleted || r.Orphans[0].Deleted != tt.wantDeleted {
+				t.Fatalf("wanted orphan deleted: %v, got deleted: %v, reported: %v", tt.wantDeleted, deleted, r.Orphans[0].Deleted)
+			}
+		})
+	}
+
+	if _, err := s.Stat(ctx, download.BlobKey(download.Digest([]byte("i am a model layer")))); err != nil {
+		t.Fatalf("reachable blob was deleted: %v", err)
+	}
+}
+
+func TestSweepMovedTag(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	oldDigest := putModel(t, s, "library/llama3", "shared layer", "old layer")
+	newDigest := putModel(t, s, "library/llama3", "shared layer", "new layer")
+
+	r, err := NewSweeper(s, nil, nil, 0).Sweep(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Reachable != 2 {
+		t.Fatalf("wanted 2 reachable blobs, got %d", r.Reachable)
+	}
+
+	var orphans []string
+	for _, o := range r.Orphans {
+		orphans = append(orphans, o.Key)
+	}
+
+	if got, want := strings.Join(orphans, " "), download.BlobKey(download.Digest([]byte("old layer")))+" "+download.ManifestKey(oldDigest); got != want {
+		t.Fatalf("wrong orphans: got %q, want %q", got, want)
+	}
+
+	for key, want := range map[string]bool{
+		download.ManifestKey(oldDigest):                           false,
+		download.ManifestKey(newDigest):                           true,
+		download.BlobKey(download.Digest([]byte("old layer"))):    false,
+		download.BlobKey(download.Digest([]byte("new layer"))):    true,
+		download.BlobKey(download.Digest([]byte("shared layer"))): true,
+	} {
+		_, err := s.Stat(ctx, key)
+		if got := err == nil; got != want {
+			t.Errorf("%s: wanted kept: %v, got %v", key, want, got)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// Sweeper finds blobs and manifests that nothing refers to any more, such as the old manifest and
+// layers of a tag that moved, and deletes them.
+//
+// Marking starts from every tag, pin, and Civitai model in the store: the manifests they point at
+// and the blobs those manifests use are reachable. Manifests that are only kept by digest and any
+// blob that wasn't marked are orphans. Orphans are only deleted once they are older than the grace
+// period, so that objects that are cached before whatever uses them are left alone.
+type Sweeper struct {
+	s      store.Store
+	access *Tracker
+	pins   *pin.Set
+	grace  time.Duration
+
+	lock sync.Mutex // held while sweeping, so that only one sweep runs at a time
+	last *SweepReport
+}
+
+// NewSweeper creates a Sweeper that deletes orphans older than grace.
+func NewSweeper(s store.Store, access *Tracker, pins *pin.Set, grace time.Duration) *Sweeper {
+	return &Sweeper{
+		s:      s,
+		access: access,
+		pins:   pins,
+		grace:  grace,
+	}
+}
+
+// SweepReport is what a sweep found.
+type SweepReport struct {
+	Time      time.Time `json:"time"`
+	DryRun    bool      `json:"dryRun"`
+	Grace     string    `json:"grace"`
+	Reachable int       `json:"reachable"` // blobs
+	Orphans   []Orphan  `json:"orphans"`
+	Freed     int64     `json:"freed"`
+}
+
+// Orphan is a blob or manifest that nothing refers to.
+type Orphan struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	Deleted      bool      `json:"deleted"` // false for dry runs and orphans still in their grace period
+}
+
+// Work sweeps every period until ctx is done. Orphans are only deleted if del is set, otherwise
+// they are reported.
+func (sw *Sweeper) Work(ctx context.Context, period time.Duration, del bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("returning from sweeper work thread")
+			return
+		default:
+			r, err := sw.Sweep(ctx, !del)
+			if err != nil {
+				slog.Error("can't sweep orphaned blobs", "err", err)
+			} else if len(r.Orphans) != 0 {
+				slog.Info("found orphaned blobs", "dryRun", r.DryRun, "count", len(r.Orphans), "freed", r.Freed)
+			}
+
+			time.Sleep(period)
+		}
+	}
+}
+
+// LastReport returns the report from the last sweep, or nil if there hasn't been one.
+func (sw *Sweeper) LastReport() *SweepReport {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	return sw.last
+}
+
+// Sweep finds orphaned blobs and manifests and deletes the ones older than the grace period. If dryRun is set,
+// nothing is deleted.
+func (sw *Sweeper) Sweep(ctx context.Context, dryRun bool) (*SweepReport, error) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	// List objects before marking, so that objects cached while marking aren't mistaken for orphans.
+	blobs, err := sw.s.List(ctx, store.Query{Prefix: "blobs/"})
+	if err != nil {
+		return nil, fmt.Errorf("can't list blobs: %w", err)
+	}
+
+	manifests, err := sw.s.List(ctx, store.Query{Prefix: "manifests/"})
+	if err != nil {
+		return nil, fmt.Errorf("can't list manifests: %w", err)
+	}
+
+	models, err := findModels(ctx, sw.s, sw.pins)
+	if err != nil {
+		return nil, err
+	}
+
+	reachable := map[string]bool{}
+	var reachableBlobs int
+	for _, m := range models {
+		if !m.root {
+			continue
+		}
+
+		for _, key := range m.keys {
+			reachable[key] = true
+		}
+
+		for _, blob := range m.blobs {
+			if !reachable[blob] {
+				reachable[blob] = true
+				reachableBlobs++
+			}
+		}
+	}
+
+	r := &SweepReport{
+		Time:      time.Now(),
+		DryRun:    dryRun,
+		Grace:     sw.grace.String(),
+		Reachable: reachableBlobs,
+		Orphans:   []Orphan{},
+	}
+
+	cutoff := r.Time.Add(-sw.grace)
+
+	for _, obj := range append(blobs, manifests...) {
+		if reachable[obj.Key] {
+			continue
+		}
+
+		o := Orphan{
+			Key:          obj.Key,
+			Size:         obj.Size,
+			LastModified: obj.LastModified,
+		}
+
+		if !dryRun && obj.LastModified.Before(cutoff) {
+			if err := sw.s.Delete(ctx, obj.Key); err != nil {
+				return nil, fmt.Errorf("can't delete %s: %w", obj.Key, err)
+			}
+
+			sw.access.Forget(obj.Key)
+			o.Deleted = true
+			r.Freed += obj.Size
+		}
+
+		r.Orphans = append(r.Orphans, o)
+	}
+
+	sw.last = r
+	return r, nil
+}
@@ -0,0 +1,75 @@
+// Package modelref parses the names operators use for models on the command line and in the admin
+// API.
+package modelref
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/tigrisdata-community/yukari/civitai/air"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+)
+
+// Ref is an Ollama model (such as `library/llama3:8b`), or a Civitai model version given by its ID
+// (such as `128713`) or AIR (such as `urn:air:sd1:model:civitai:2421@43533`).
+type Ref struct {
+	Raw string `json:"ref"`
+
+	Name, Tag    string `json:"-"` // Ollama models
+	ModelVersion string `json:"-"` // Civitai models
+}
+
+// IsCivitai returns true if r is a Civitai model version.
+func (r Ref) IsCivitai() bool {
+	return r.ModelVersion != ""
+}
+
+// Key returns the key of an Ollama model's tag.
+func (r Ref) Key() string {
+	return pin.TagKey(r.Name, r.Tag)
+}
+
+func (r Ref) String() string {
+	return r.Raw
+}
+
+// Parse parses a model reference.
+func Parse(s string) (Ref, error) {
+	r := Ref{Raw: s}
+
+	id, err := air.Parse(s)
+	switch {
+	case err == nil:
+		if id.Source != "civitai" || id.ModelVersion == "" {
+			return Ref{}, fmt.Errorf("can't use %s: only Civitai AIRs with a model version are supported", s)
+		}
+		r.ModelVersion = id.ModelVersion
+	case !errors.Is(err, air.ErrNotAIR):
+		return Ref{}, fmt.Errorf("can't parse %s: %w", s, err)
+	default:
+		if _, err := strconv.Atoi(s); err == nil {
+			r.ModelVersion = s
+		} else {
+			r.Name, r.Tag = pin.SplitRef(s)
+		}
+	}
+
+	return r, nil
+}
+
+// ParseAll parses every model reference in refs.
+func ParseAll(refs []string) ([]Ref, error) {
+	var result []Ref
+
+	for _, s := range refs {
+		r, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, r)
+	}
+
+	return result, nil
+}
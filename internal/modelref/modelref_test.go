@@ -0,0 +1,33 @@
+package modelref
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    Ref
+		wantErr bool
+	}{
+		{in: "library/llama3:8b", want: Ref{Name: "library/llama3", Tag: "8b"}},
+		{in: "library/llama3", want: Ref{Name: "library/llama3", Tag: "latest"}},
+		{in: "128713", want: Ref{ModelVersion: "128713"}},
+		{in: "urn:air:sd1:model:civitai:2421@43533", want: Ref{ModelVersion: "43533"}},
+		{in: "urn:air:sd1:model:huggingface:2421@43533", wantErr: true},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wanted error: %v, got: %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			tt.want.Raw = tt.in
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
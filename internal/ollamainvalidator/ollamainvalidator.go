@@ -2,23 +2,33 @@ package ollamainvalidator
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log/slog"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/tigrisdata-community/yukari/internal/download"
-	"github.com/tigrisdata-community/yukari/tigris"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+	"github.com/tigrisdata-community/yukari/internal/upstream"
 )
 
 type Worker struct {
-	s3c        *s3.Client
-	bucketName string
-	d          *download.Downloader
+	s      store.Store
+	d      *download.Downloader
+	routes *upstream.Table
+	pins   *pin.Set
+
+	// checked is when each manifest (or tag) was last modified the last time its blobs were checked,
+	// so that only manifests that changed since then are checked again.
+	checked map[string]time.Time
 }
 
-func New(s3c *s3.Client, d *download.Downloader, bucketName string) *Worker {
-	return &Worker{s3c, bucketName, d}
+// New creates a Worker. Manifests are refreshed from the URL they were originally downloaded from,
+// or from the upstream routes picks for them if that wasn't recorded. Tags in pins are never
+// refreshed, but the manifests they are pinned to are kept fully cached.
+func New(s store.Store, d *download.Downloader, routes *upstream.Table, pins *pin.Set) *Worker {
+	return &Worker{s: s, d: d, routes: routes, pins: pins, checked: map[string]time.Time{}}
 }
 
 func (w *Worker) Work(ctx context.Context, invalidatorPeriod, manifestLifetime time.Duration) {
@@ -28,28 +38,141 @@ func (w *Worker) Work(ctx context.Context, invalidatorPeriod, manifestLifetime t
 			slog.Info("returning from downloader work thread")
 			return
 		default:
-			t := time.Now()
-			t = t.Add(-1 * manifestLifetime)
+			w.check(ctx, time.Now().Add(-1*manifestLifetime))
 
-			aWeekAgo := t.Format(time.RFC3339)
-			q := fmt.Sprintf("`Content-Type` = \"application/vnd.docker.distribution.manifest.v2+json\" AND `Last-Modified` < %q", aWeekAgo)
+			time.Sleep(invalidatorPeriod)
+		}
+	}
+}
 
-			objects, err := w.s3c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-				Bucket: &w.bucketName,
-			}, tigris.WithQuery(q))
-			if err != nil {
-				slog.Error("can't list objects", "err", err)
-			}
+// check re-fetches tags last checked before staleBefore and re-queues any blobs missing from the
+// other manifests and pinned manifests, so that every cached model ends up fully cached. Manifests
+// are only checked for missing blobs when they changed since the last check, which they do every
+// time they are refreshed.
+func (w *Worker) check(ctx context.Context, staleBefore time.Time) {
+	var objects []store.ObjectInfo
 
-			for _, obj := range objects.Contents {
-				slog.Debug("found old manifest, reprocessing", "key", *obj.Key, "lastModified", obj.LastModified.Format(time.RFC3339))
+	// Anything that wasn't seen this time was deleted, and is forgotten.
+	checked := w.checked
+	w.checked = map[string]time.Time{}
 
-				manifestURL := fmt.Sprintf("https://registry.ollama.ai/%s", *obj.Key)
+	// Manifests cached before tags were stored as pointers are still manifests.
+	for _, contentType := range []string{download.TagMediaType, download.ManifestMediaType} {
+		found, err := w.s.List(ctx, store.Query{
+			Prefix:      "v2/",
+			ContentType: contentType,
+		})
+		if err != nil {
+			slog.Error("can't list objects", "contentType", contentType, "err", err)
+			return
+		}
 
-				w.d.Fetch(w.bucketName, *obj.Key, manifestURL, "application/vnd.docker.distribution.manifest.v2+json", "")
-			}
+		objects = append(objects, found...)
+	}
 
-			time.Sleep(invalidatorPeriod)
+	for _, p := range w.pins.List() {
+		w.checkPin(ctx, p, checked)
+	}
+
+	for _, obj := range objects {
+		if _, ok := w.pins.Pinned(obj.Key); ok {
+			continue
 		}
+
+		manifestURL, err := w.manifestURL(ctx, obj.Key)
+		if err != nil {
+			slog.Error("can't find upstream for manifest", "key", obj.Key, "err", err)
+			continue
+		}
+
+		if obj.LastModified.Before(staleBefore) {
+			slog.Debug("found old manifest, reprocessing", "key", obj.Key, "lastModified", obj.LastModified.Format(time.RFC3339))
+
+			w.d.Fetch(download.Request{
+				Key:       obj.Key,
+				PullURL:   manifestURL,
+				MediaType: download.ManifestMediaType,
+				Refresh:   true,
+			})
+			continue
+		}
+
+		w.fetchMissingBlobs(ctx, obj, manifestURL, checked)
+	}
+}
+
+// checkPin makes sure the manifest a tag is pinned to and all of its blobs are cached.
+func (w *Worker) checkPin(ctx context.Context, p pin.Pin, checked map[string]time.Time) {
+	tagURL, err := w.manifestURL(ctx, p.Key())
+	if err != nil {
+		slog.Error("can't find upstream for pinned manifest", "pin", p.String(), "err", err)
+		return
+	}
+
+	// Pinned manifests are fetched by digest, so that they are right even if the tag moved.
+	manifestURL := tagURL[:strings.LastIndex(tagURL, "/")+1] + p.Digest
+	key := download.ManifestKey(p.Digest)
+
+	info, err := w.s.Stat(ctx, key)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		slog.Debug("pinned manifest isn't cached, fetching it", "pin", p.String())
+
+		w.d.Fetch(download.Request{
+			Key:     key,
+			PullURL: manifestURL,
+		})
+		return
+	case err != nil:
+		slog.Error("can't check if pinned manifest is cached", "pin", p.String(), "err", err)
+		return
 	}
+
+	w.fetchMissingBlobs(ctx, *info, manifestURL, checked)
+}
+
+// fetchMissingBlobs queues any blobs of the manifest in obj that aren't in the store, unless it
+// hasn't changed since it was last checked.
+func (w *Worker) fetchMissingBlobs(ctx context.Context, obj store.ObjectInfo, manifestURL string, checked map[string]time.Time) {
+	key := obj.Key
+
+	if last, ok := checked[key]; ok && last.Equal(obj.LastModified) {
+		w.checked[key] = last
+		return
+	}
+
+	m, err := download.LoadManifest(ctx, w.s, key)
+	if err != nil {
+		slog.Error("can't load manifest", "key", key, "err", err)
+		return
+	}
+
+	cached, err := download.FullyCached(ctx, w.s, *m)
+	if err != nil {
+		slog.Error("can't check if manifest is cached", "key", key, "err", err)
+		return
+	}
+
+	if !cached {
+		slog.Debug("manifest is missing blobs, fetching them", "key", key)
+		w.d.FetchBlobs(*m, manifestURL, "")
+	}
+
+	w.checked[key] = obj.LastModified
+}
+
+// manifestURL returns the URL the manifest at key was downloaded from. Credentials for it are
+// added by the downloader's client.
+func (w *Worker) manifestURL(ctx context.Context, key string) (string, error) {
+	info, err := w.s.Stat(ctx, key)
+	if err == nil && info.Metadata[download.MetadataPullURL] != "" {
+		return info.Metadata[download.MetadataPullURL], nil
+	}
+
+	_, pullURL, err := w.routes.Resolve(key)
+	if err != nil {
+		return "", err
+	}
+
+	return pullURL.String(), nil
 }
@@ -0,0 +1,44 @@
+package ollamaproxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes from the distribution spec.
+const (
+	codeBlobUnknown     = "BLOB_UNKNOWN"
+	codeManifestUnknown = "MANIFEST_UNKNOWN"
+)
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  any    `json:"detail,omitempty"`
+}
+
+// writeRegistryError answers a request with an error in the format registry clients understand.
+func writeRegistryError(w http.ResponseWriter, status int, code, message string, detail any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(struct {
+		Errors []registryError `json:"errors"`
+	}{
+		Errors: []registryError{{Code: code, Message: message, Detail: detail}},
+	})
+}
+
+// notCached answers a request for something that isn't in the store when Yukari is offline.
+func notCached(w http.ResponseWriter, r *http.Request, isManifest, isBlob bool) {
+	detail := map[string]string{"path": r.URL.Path}
+
+	switch {
+	case isManifest:
+		writeRegistryError(w, http.StatusNotFound, codeManifestUnknown, "manifest unknown, and yukari is offline", detail)
+	case isBlob:
+		writeRegistryError(w, http.StatusNotFound, codeBlobUnknown, "blob unknown, and yukari is offline", detail)
+	default:
+		http.NotFound(w, r)
+	}
+}
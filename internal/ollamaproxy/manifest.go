@@ -0,0 +1,49 @@
+package ollamaproxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// cachedManifest is a manifest read from the store. Manifests are small, so they are always sent
+// from memory instead of being redirected to the store.
+type cachedManifest struct {
+	store.ObjectInfo
+	data   []byte
+	digest string
+}
+
+// loadManifest reads the manifest at key, following key if it is a tag.
+func loadManifest(ctx context.Context, s store.Store, key string) (*cachedManifest, error) {
+	info, data, digest, err := download.ReadManifest(ctx, s, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedManifest{
+		ObjectInfo: *info,
+		data:       data,
+		digest:     digest,
+	}, nil
+}
+
+// serveManifest answers a manifest GET or HEAD request with the headers the distribution spec
+// requires, so that clients can verify the manifest's digest.
+func serveManifest(w http.ResponseWriter, r *http.Request, m *cachedManifest) {
+	mediaType := m.ContentType
+	if mediaType == "" {
+		mediaType = download.ManifestMediaType
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.data)))
+	w.Header().Set("Docker-Content-Digest", m.digest)
+	w.Header().Set("ETag", strconv.Quote(m.digest))
+
+	http.ServeContent(w, r, "", m.LastModified, bytes.NewReader(m.data))
+}
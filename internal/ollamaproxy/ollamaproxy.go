@@ -1,26 +1,47 @@
 package ollamaproxy
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"path"
+	"strconv"
 	"strings"
 
-	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/gc"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+	"github.com/tigrisdata-community/yukari/internal/upstream"
 )
 
-func Handler(p *httputil.ReverseProxy, d *download.Downloader, bucketName string, upstream url.URL, s3c *s3.Client) http.Handler {
-	presignClient := s3.NewPresignClient(s3c)
+// Handler serves Ollama registry requests from the store, falling back to the upstream registry
+// picked by routes (and queueing the object for caching) on a miss.
+//
+// If streamThrough is set, cache misses for blobs are served by downloading the blob from upstream
+// once, saving it to the store while it is sent to the client. Concurrent requests for the same blob
+// follow the same download instead of making their own.
+//
+// If offline is set, upstream is never contacted: misses are answered with MANIFEST_UNKNOWN or
+// BLOB_UNKNOWN errors instead of being proxied, and nothing is downloaded or revalidated.
+//
+// If rv is not nil, cached manifests are checked against upstream before they are served. Manifests
+// that changed upstream are proxied and refreshed, as if they weren't cached. Manifests pulled by
+// digest can't change, so they are never checked.
+//
+// Tags in pins are always served at their pinned digest. Everything served from the store is
+// recorded in access, so that the least recently used models can be evicted.
+func Handler(routes *upstream.Table, d *download.Downloader, s store.Store, streamThrough, offline bool, rv *Revalidator, pins *pin.Set, access *gc.Tracker) http.Handler {
+	// Requests already point at their upstream by the time they are proxied.
+	p := &httputil.ReverseProxy{
+		Director:  func(*http.Request) {},
+		Transport: routes.Transport(),
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.Host = upstream.Host
-		r.URL.Host = upstream.Host
-		r.URL.Scheme = upstream.Scheme
-
 		lg := slog.With(
 			"component", "handler",
 			"method", r.Method,
@@ -34,58 +55,181 @@ func Handler(p *httputil.ReverseProxy, d *download.Downloader, bucketName string
 			return
 		}
 
-		cachePath := r.URL.Path
+		cachePath := strings.TrimPrefix(r.URL.Path, "/")
 		endComponent := path.Base(r.URL.Path)
-		if strings.HasPrefix(endComponent, "sha256:") {
-			cachePath = path.Join("blobs", endComponent)
+		isDigest := strings.HasPrefix(endComponent, "sha256:")
+		isManifest := strings.Contains(r.URL.Path, "/manifests/")
+		isBlob := isDigest && !isManifest
+
+		// Blobs and manifests pulled by digest are shared between every repository. Manifests pulled
+		// by tag are stored under their path, pointing at the manifest's digest.
+		switch {
+		case isBlob:
+			cachePath = download.BlobKey(endComponent)
+		case isManifest && isDigest:
+			cachePath = download.ManifestKey(endComponent)
+		}
+
+		// Pinned tags are served as if the client asked for the pinned digest, whatever the tag
+		// points at upstream.
+		pinned := false
+		if digest, ok := pins.Pinned(cachePath); ok && isManifest {
+			cachePath = download.ManifestKey(digest)
+			endComponent = digest
+			isDigest = true
+			pinned = true
+		}
+
+		route, pullURL, err := routes.Resolve(r.URL.Path)
+		if err != nil {
+			lg.Debug("no upstream for path", "path", r.URL.Path, "err", err)
+			http.NotFound(w, r)
+			return
+		}
+		pullURL.RawQuery = r.URL.RawQuery
+		if pinned {
+			pullURL.Path = path.Join(path.Dir(pullURL.Path), endComponent)
+			pullURL.RawPath = ""
 		}
 
-		cachePath = strings.TrimPrefix(cachePath, "/")
+		// Routes with their own credentials get authenticated by routes.Transport, so the client's
+		// credentials are never sent to them.
+		authorization := r.Header.Get("Authorization")
+		if route.HasCredentials() {
+			authorization = ""
+			r.Header.Del("Authorization")
+		}
 
 		lg = lg.With(
-			"bucket", bucketName,
 			"cachePath", cachePath,
+			"upstream", route.Name(),
 		)
 
-		if _, err := s3c.HeadObject(r.Context(), &s3.HeadObjectInput{
-			Bucket: &bucketName,
-			Key:    &cachePath,
-		}); err == nil {
-			lg.Debug("object in bucket")
-
-			// if strings.Contains(r.URL.Path, "sha256:") {
-			// Object is in bucket, send back a redirect to a presigned URL for blobs
-			var req *v4.PresignedHTTPRequest
-			var err error
-			switch r.Method {
-			case http.MethodHead:
-				req, err = presignClient.PresignHeadObject(r.Context(), &s3.HeadObjectInput{
-					Bucket: &bucketName,
-					Key:    &cachePath,
-				})
-			case http.MethodGet:
-				req, err = presignClient.PresignGetObject(r.Context(), &s3.GetObjectInput{
-					Bucket: &bucketName,
-					Key:    &cachePath,
-				})
+		// refresh is set if a cached manifest is out of date, so the downloader replaces it.
+		var refresh bool
+
+		if info, err := s.Stat(r.Context(), cachePath); err == nil && isManifest {
+			m, err := loadManifest(r.Context(), s, info.Key)
+			switch {
+			case errors.Is(err, store.ErrNotFound):
+				lg.Warn("tag points at a manifest that isn't cached, refreshing it")
+			case err != nil:
+				lg.Error("can't load manifest", "err", err)
+				http.Error(w, "can't serve manifest, sorry :(", http.StatusInternalServerError)
+				return
+			case rv == nil || offline || isDigest || revalidate(r.Context(), lg, rv, m, pullURL.String(), authorization):
+				lg.Info("serving", "from", "store", "mode", "manifest")
+				access.Touch(info.Key)
+				access.Touch(m.Key)
+				serveManifest(w, r, m)
+				return
 			}
 
-			if err != nil {
-				lg.Error("can't get presigned url", "err", err)
-				http.Error(w, "can't make presigned url, sorry :(", http.StatusInternalServerError)
-				return
+			refresh = true
+		} else if err == nil {
+			lg.Info("serving", "from", "store", "mode", route.Serve)
+			access.Touch(info.Key)
+
+			if isBlob {
+				w.Header().Set("Docker-Content-Digest", endComponent)
 			}
 
-			lg.Info("serving", "from", "tigris")
-			http.Redirect(w, r, req.URL, http.StatusTemporaryRedirect)
+			if err := store.Serve(w, r, s, info, route.Serve); err != nil {
+				lg.Error("can't serve object from store", "err", err)
+				http.Error(w, "can't serve object from store, sorry :(", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if offline {
+			lg.Info("not cached and offline")
+			notCached(w, r, isManifest, isBlob)
 			return
 		}
 
+		if streamThrough && isBlob && r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+			err := serveStreamThrough(w, r, d, routes.Client(), cachePath, pullURL.String(), authorization)
+			if err == nil {
+				return
+			}
+
+			lg.Error("can't stream through, proxying instead", "err", err)
+		}
+
 		// File does not exist in cache. Queue the download & serve from upstream
 		lg.Info("serving", "source", "origin")
 
-		d.Fetch(bucketName, cachePath, r.URL.String(), "", r.Header.Get("Authorization"))
+		d.Fetch(download.Request{
+			Key:                 cachePath,
+			PullURL:             pullURL.String(),
+			AuthorizationHeader: authorization,
+			Refresh:             refresh,
+		})
+
+		r.URL = pullURL
+		r.Host = pullURL.Host
 
 		p.ServeHTTP(w, r)
 	})
 }
+
+// serveStreamThrough sends a blob to the client as it is downloaded into the store. If this returns
+// an error, nothing has been written to w yet.
+func serveStreamThrough(w http.ResponseWriter, r *http.Request, d *download.Downloader, cli *http.Client, cachePath, pullURL, authorizationHeader string) error {
+	dl := download.Request{
+		Key:                 cachePath,
+		PullURL:             pullURL,
+		AuthorizationHeader: authorizationHeader,
+	}
+
+	st, body, err := d.StreamThrough(r.Context(), dl, func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pullURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if authorizationHeader != "" {
+			req.Header.Set("Authorization", authorizationHeader)
+		}
+
+		return cli.Do(req)
+	})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	slog.Info("serving", "component", "handler", "cachePath", cachePath, "source", "stream")
+
+	if st.ContentType != "" {
+		w.Header().Set("Content-Type", st.ContentType)
+	}
+	if st.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(st.Size, 10))
+	}
+	w.Header().Set("Docker-Content-Digest", path.Base(cachePath))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, body); err != nil {
+		slog.Debug("client stopped following stream", "cachePath", cachePath, "err", err)
+	}
+
+	return nil
+}
+
+// revalidate returns true if a cached manifest can be served: either upstream has the same digest
+// for it, or upstream can't be reached.
+func revalidate(ctx context.Context, lg *slog.Logger, rv *Revalidator, m *cachedManifest, pullURL, authorization string) bool {
+	digest, err := rv.UpstreamDigest(ctx, pullURL, authorization)
+	if err != nil {
+		lg.Warn("can't revalidate manifest, serving it from cache", "err", err)
+		return true
+	}
+
+	if digest != m.digest {
+		lg.Info("cached manifest is out of date", "cachedDigest", m.digest, "upstreamDigest", digest)
+		return false
+	}
+
+	return true
+}
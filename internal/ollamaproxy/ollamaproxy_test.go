@@ -0,0 +1,576 @@
+package ollamaproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+	"github.com/tigrisdata-community/yukari/internal/throttle"
+	"github.com/tigrisdata-community/yukari/internal/upstream"
+)
+
+const testBlob = "blobs/sha256:4dc7aa34615388a266ce5e58cd0e7ad5a8a0af358d2d100b509f723305eb38bb"
+
+func TestHandlerCachesMisses(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/library/llama3/"+testBlob {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, "i am a model layer")
+	}))
+	defer origin.Close()
+
+	routes, err := upstream.New([]upstream.Route{{URL: origin.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewMemory()
+	d := download.New(s, download.Options{})
+	go d.Work(ctx)
+
+	h := Handler(routes, d, s, false, false, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/llama3/"+testBlob, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wanted status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	if got := rec.Body.String(); got != "i am a model layer" {
+		t.Fatalf("wrong body from origin: %q", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.Stat(ctx, testBlob); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("blob was never cached")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandlerStreamsWithoutPresign(t *testing.T) {
+	ctx := context.Background()
+
+	s := store.NewMemory()
+	if err := s.Put(ctx, testBlob, strings.NewReader("i am a model layer"), -1, store.PutOptions{ContentType: "application/octet-stream"}); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := upstream.New([]upstream.Route{{URL: "http://upstream.invalid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(routes, download.New(s, download.Options{}), s, false, false, nil, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/llama3/"+testBlob, nil)
+	req.Header.Set("Range", "bytes=5-")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("wanted status %d, got %d", http.StatusPartialContent, rec.Code)
+	}
+
+	if got := rec.Body.String(); got != "a model layer" {
+		t.Fatalf("wrong body from store: %q", got)
+	}
+}
+
+func TestHandlerStreamThrough(t *testing.T) {
+	var hits atomic.Int64
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+
+		// give the other client time to attach to this stream
+		time.Sleep(250 * time.Millisecond)
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, "i am a model layer")
+	}))
+	defer origin.Close()
+
+	routes, err := upstream.New([]upstream.Route{{URL: origin.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := store.NewMemory()
+	h := Handler(routes, download.New(s, download.Options{}), s, true, false, nil, nil, nil)
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/llama3/"+testBlob, nil))
+
+			if got := rec.Body.String(); got != "i am a model layer" {
+				t.Errorf("wrong body from stream: %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("wanted 1 request to origin, got %d", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.Stat(context.Background(), testBlob); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("blob was never cached")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandlerRoutes(t *testing.T) {
+	var gotPath, gotAuthorization string
+
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuthorization = r.Header.Get("Authorization")
+
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		io.WriteString(w, `{"schemaVersion":2}`)
+	}))
+	defer internal.Close()
+
+	routes, err := upstream.New([]upstream.Route{
+		{URL: "http://upstream.invalid"},
+		{Prefix: "internal", URL: internal.URL, Token: "hunter2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := store.NewMemory()
+	h := Handler(routes, download.New(s, download.Options{}), s, false, false, nil, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/internal/team/model/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer client-token")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wanted status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	if gotPath != "/v2/team/model/manifests/latest" {
+		t.Fatalf("wrong path sent upstream: %q", gotPath)
+	}
+
+	if gotAuthorization != "Bearer hunter2" {
+		t.Fatalf("route credentials were not used, got Authorization %q", gotAuthorization)
+	}
+}
+
+// presignStore is a store that can presign URLs, like S3.
+type presignStore struct {
+	store.Store
+}
+
+func (presignStore) Presign(ctx context.Context, method, key string) (string, error) {
+	return "https://bucket.invalid/" + key, nil
+}
+
+func TestHandlerServeModes(t *testing.T) {
+	ctx := context.Background()
+
+	s := presignStore{store.NewMemory()}
+	if err := s.Put(ctx, testBlob, strings.NewReader("i am a model layer"), -1, store.PutOptions{ContentType: "application/octet-stream"}); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := upstream.New([]upstream.Route{
+		{URL: "http://upstream.invalid"},
+		{Prefix: "firewalled", URL: "http://upstream.invalid", Serve: store.ServeProxy},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(routes, download.New(s, download.Options{}), s, false, false, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/llama3/"+testBlob, nil))
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("wanted a redirect from the default route, got status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/firewalled/library/llama3/"+testBlob, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wanted status %d from the proxied route, got %d", http.StatusOK, rec.Code)
+	}
+
+	for header, want := range map[string]string{
+		"Content-Length":        "18",
+		"Content-Type":          "application/octet-stream",
+		"Docker-Content-Digest": path.Base(testBlob),
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("wrong %s: got %q, want %q", header, got, want)
+		}
+	}
+
+	if rec.Header().Get("ETag") == "" {
+		t.Error("no ETag")
+	}
+
+	if got := rec.Body.String(); got != "i am a model layer" {
+		t.Fatalf("wrong body: %q", got)
+	}
+}
+
+func TestHandlerServesManifests(t *testing.T) {
+	ctx := context.Background()
+
+	const (
+		manifest  = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json"}`
+		mediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	)
+
+	s := presignStore{store.NewMemory()}
+	if err := s.Put(ctx, "v2/library/llama3/manifests/latest", strings.NewReader(manifest), -1, store.PutOptions{ContentType: mediaType}); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := upstream.New([]upstream.Route{{URL: "http://upstream.invalid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(routes, download.New(s, download.Options{}), s, false, false, nil, nil, nil)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		t.Run(method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(method, "/v2/library/llama3/manifests/latest", nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("wanted status %d, got %d", http.StatusOK, rec.Code)
+			}
+
+			for header, want := range map[string]string{
+				"Content-Type":          mediaType,
+				"Content-Length":        strconv.Itoa(len(manifest)),
+				"Docker-Content-Digest": download.Digest([]byte(manifest)),
+			} {
+				if got := rec.Header().Get(header); got != want {
+					t.Errorf("wrong %s: got %q, want %q", header, got, want)
+				}
+			}
+
+			wantBody := manifest
+			if method == http.MethodHead {
+				wantBody = ""
+			}
+
+			if got := rec.Body.String(); got != wantBody {
+				t.Errorf("wrong body: %q", got)
+			}
+		})
+	}
+}
+
+func TestHandlerRevalidatesManifests(t *testing.T) {
+	const (
+		cached = `{"schemaVersion":2,"layers":[]}`
+		fresh  = `{"schemaVersion":2,"layers":[{}]}`
+	)
+
+	for _, tt := range []struct {
+		name     string
+		digest   string // sent by upstream, empty means upstream is down
+		wantBody string
+	}{
+		{name: "unchanged", digest: download.Digest([]byte(cached)), wantBody: cached},
+		{name: "changed", digest: download.Digest([]byte(fresh)), wantBody: fresh},
+		{name: "unreachable", wantBody: cached},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var heads atomic.Int64
+
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.digest == "" {
+					http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+					return
+				}
+
+				if r.Method == http.MethodHead {
+					heads.Add(1)
+				}
+
+				w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+				w.Header().Set("Docker-Content-Digest", tt.digest)
+				io.WriteString(w, fresh)
+			}))
+			defer origin.Close()
+
+			s := store.NewMemory()
+			if err := s.Put(context.Background(), "v2/library/llama3/manifests/latest", strings.NewReader(cached), -1, store.PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := upstream.New([]upstream.Route{{URL: origin.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rv := NewRevalidator(routes.Client(), time.Minute, time.Minute)
+			h := Handler(routes, download.New(s, download.Options{}), s, false, false, rv, nil, nil)
+
+			for range 2 {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/llama3/manifests/latest", nil))
+
+				if rec.Code != http.StatusOK {
+					t.Fatalf("wanted status %d, got %d", http.StatusOK, rec.Code)
+				}
+
+				if got := rec.Body.String(); got != tt.wantBody {
+					t.Fatalf("wrong body: got %q, want %q", got, tt.wantBody)
+				}
+			}
+
+			if tt.digest != "" && heads.Load() != 1 {
+				t.Fatalf("wanted 1 HEAD request upstream, got %d", heads.Load())
+			}
+		})
+	}
+}
+
+func TestHandlerServesManifestsByDigest(t *testing.T) {
+	ctx := context.Background()
+
+	const manifest = `{"schemaVersion":2,"layers":[]}`
+	digest := download.Digest([]byte(manifest))
+
+	s := store.NewMemory()
+	if err := s.Put(ctx, download.ManifestKey(digest), strings.NewReader(manifest), -1, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// upstream is unreachable, so this has to come from the cache
+	routes, err := upstream.New([]upstream.Route{{URL: "http://upstream.invalid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(routes, download.New(s, download.Options{}), s, false, false, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/llama3/manifests/"+digest, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wanted status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	if got := rec.Header().Get("Docker-Content-Digest"); got != digest {
+		t.Fatalf("wrong Docker-Content-Digest: got %q, want %q", got, digest)
+	}
+
+	if got := rec.Body.String(); got != manifest {
+		t.Fatalf("wrong body: %q", got)
+	}
+}
+
+func TestHandlerServesPinnedTags(t *testing.T) {
+	ctx := context.Background()
+
+	const (
+		pinned = `{"schemaVersion":2,"layers":[]}`
+		moved  = `{"schemaVersion":2,"layers":[{}]}`
+	)
+	digest := download.Digest([]byte(pinned))
+
+	var gotPath string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		io.WriteString(w, moved)
+	}))
+	defer origin.Close()
+
+	s := store.NewMemory()
+	if err := s.Put(ctx, download.ManifestKey(digest), strings.NewReader(pinned), -1, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pins, err := pin.Load(ctx, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []pin.Pin{
+		{Name: "library/llama3", Tag: "latest", Digest: digest},
+		{Name: "library/qwen2", Tag: "latest", Digest: download.Digest([]byte("not cached"))},
+	} {
+		if err := pins.Add(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	routes, err := upstream.New([]upstream.Route{{URL: origin.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(routes, download.New(s, download.Options{}), s, false, false, nil, pins, nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/llama3/manifests/latest", nil))
+
+	if got := rec.Body.String(); got != pinned {
+		t.Fatalf("pinned tag served the wrong manifest: %q", got)
+	}
+
+	if gotPath != "" {
+		t.Fatalf("pinned tag went upstream: %s", gotPath)
+	}
+
+	// Pinned manifests that aren't cached are pulled by digest.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/qwen2/manifests/latest", nil))
+
+	if want := "/v2/library/qwen2/manifests/" + download.Digest([]byte("not cached")); gotPath != want {
+		t.Fatalf("wrong path sent upstream: got %q, want %q", gotPath, want)
+	}
+}
+
+func TestHandlerOffline(t *testing.T) {
+	ctx := context.Background()
+
+	var hits atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "i am upstream")
+	}))
+	defer origin.Close()
+
+	s := store.NewMemory()
+	if err := s.Put(ctx, testBlob, strings.NewReader("i am a model layer"), -1, store.PutOptions{ContentType: "application/octet-stream"}); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := upstream.New([]upstream.Route{{URL: origin.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(routes, download.New(s, download.Options{}), s, true, true, nil, nil, nil)
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/v2/library/llama3/" + testBlob, http.StatusOK, ""},
+		{"/v2/library/llama3/blobs/sha256:0000000000000000000000000000000000000000000000000000000000000000", http.StatusNotFound, codeBlobUnknown},
+		{"/v2/library/llama3/manifests/8b", http.StatusNotFound, codeManifestUnknown},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if rec.Code != tt.status {
+			t.Fatalf("%s: wanted status %d, got %d", tt.path, tt.status, rec.Code)
+		}
+
+		if tt.code != "" && !strings.Contains(rec.Body.String(), `"code":"`+tt.code+`"`) {
+			t.Fatalf("%s: wanted error %s, got %s", tt.path, tt.code, rec.Body.String())
+		}
+	}
+
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("wanted no requests upstream, got %d", n)
+	}
+}
+
+func TestHandlerDoesNotThrottleClients(t *testing.T) {
+	// at 32KiB/s, a throttled download of this would take about 7 seconds
+	body := strings.Repeat("i am a model layer", 256<<10/18)
+	sum := sha256.Sum256([]byte(body))
+	key := "blobs/sha256:" + hex.EncodeToString(sum[:])
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+
+	routes, err := upstream.New([]upstream.Route{{URL: origin.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name          string
+		streamThrough bool
+	}{
+		{name: "pass-through"},
+		{name: "stream-through", streamThrough: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewMemory()
+			d := download.New(s, download.Options{Throttle: throttle.New(32<<10, nil, throttle.Window{})})
+			h := Handler(routes, d, s, tt.streamThrough, false, nil, nil, nil)
+
+			start := time.Now()
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/llama3/"+key, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("wanted status %d, got %d", http.StatusOK, rec.Code)
+			}
+
+			if rec.Body.String() != body {
+				t.Fatalf("wrong body, got %d bytes", rec.Body.Len())
+			}
+
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("client download was throttled, took %s", elapsed)
+			}
+		})
+	}
+}
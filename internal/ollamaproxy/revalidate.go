@@ -0,0 +1,104 @@
+package ollamaproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/download"
+)
+
+// revalidateTimeout is how long to wait for upstream before serving a cached manifest anyway.
+const revalidateTimeout = 5 * time.Second
+
+// Revalidator checks cached manifests against upstream before they are served, so that a tag that
+// moved upstream is never served stale. Answers from upstream are remembered for a short time so that
+// a busy tag doesn't turn into a HEAD request per pull, and failures are remembered for even less
+// time so that a dead upstream doesn't slow every pull down.
+type Revalidator struct {
+	cli         *http.Client
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	lock    sync.Mutex
+	results map[string]revalidation // keyed by upstream URL
+}
+
+type revalidation struct {
+	digest  string
+	err     error
+	expires time.Time
+}
+
+// NewRevalidator creates a Revalidator that HEADs manifests with cli, remembering digests for ttl and
+// failures for negativeTTL.
+func NewRevalidator(cli *http.Client, ttl, negativeTTL time.Duration) *Revalidator {
+	return &Revalidator{
+		cli:         cli,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		results:     map[string]revalidation{},
+	}
+}
+
+// UpstreamDigest returns the digest of the manifest at pullURL according to upstream.
+func (rv *Revalidator) UpstreamDigest(ctx context.Context, pullURL, authorization string) (string, error) {
+	rv.lock.Lock()
+	result, ok := rv.results[pullURL]
+	rv.lock.Unlock()
+
+	if ok && time.Now().Before(result.expires) {
+		return result.digest, result.err
+	}
+
+	digest, err := rv.head(ctx, pullURL, authorization)
+
+	ttl := rv.ttl
+	if err != nil {
+		ttl = rv.negativeTTL
+	}
+
+	rv.lock.Lock()
+	rv.results[pullURL] = revalidation{
+		digest:  digest,
+		err:     err,
+		expires: time.Now().Add(ttl),
+	}
+	rv.lock.Unlock()
+
+	return digest, err
+}
+
+func (rv *Revalidator) head(ctx context.Context, pullURL, authorization string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, pullURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("can't make request: %w", err)
+	}
+
+	req.Header.Set("Accept", download.ManifestAccept)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := rv.cli.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("can't reach upstream: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("wrong status from upstream: want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("upstream didn't send a Docker-Content-Digest header")
+	}
+
+	return digest, nil
+}
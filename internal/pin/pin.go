@@ -0,0 +1,268 @@
+// Package pin keeps track of tags that are locked to a specific manifest, so that the models they
+// point at are never refreshed or evicted from the cache.
+//
+// Pins come from a pin file (a lockfile that is checked into version control next to the deployment)
+// and from the admin API. Pins made with the admin API are kept in the store so that they survive
+// restarts.
+package pin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// storeKey is where pins made with the admin API are kept.
+const storeKey = "yukari/pins"
+
+var (
+	// ErrNotPinned is returned when removing a pin that doesn't exist.
+	ErrNotPinned = errors.New("pin: tag is not pinned")
+
+	// ErrFromFile is returned when trying to change a pin that comes from the pin file.
+	ErrFromFile = errors.New("pin: tag is pinned in the pin file")
+)
+
+// Pin locks a tag to a manifest digest.
+type Pin struct {
+	Name   string `json:"name"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+
+	// FromFile is set for pins that come from the pin file and can't be changed with the API.
+	FromFile bool `json:"fromFile"`
+}
+
+// Parse parses a pin in the form `model:tag@digest`, such as
+// `library/llama3:latest@sha256:6a0746a1ec1a...`. The tag defaults to `latest`.
+func Parse(s string) (Pin, error) {
+	ref, digest, ok := strings.Cut(strings.TrimSpace(s), "@")
+	if !ok || !strings.HasPrefix(digest, "sha256:") {
+		return Pin{}, fmt.Errorf("can't parse pin %q: want model:tag@sha256:digest", s)
+	}
+
+	name, tag := SplitRef(ref)
+	if name == "" {
+		return Pin{}, fmt.Errorf("can't parse pin %q: no model name", s)
+	}
+
+	return Pin{Name: name, Tag: tag, Digest: digest}, nil
+}
+
+// SplitRef splits a model reference (such as `library/llama3:8b`) into its name and tag. The tag
+// defaults to `latest`.
+func SplitRef(ref string) (name, tag string) {
+	name, tag = ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+
+	return name, tag
+}
+
+// TagKey returns the key a tag is stored at.
+func TagKey(name, tag string) string {
+	return "v2/" + name + "/manifests/" + tag
+}
+
+// Key returns the key of the pinned tag.
+func (p Pin) Key() string {
+	return TagKey(p.Name, p.Tag)
+}
+
+func (p Pin) String() string {
+	return p.Name + ":" + p.Tag + "@" + p.Digest
+}
+
+// Set is every pin Yukari knows about. A nil *Set has no pins.
+type Set struct {
+	s store.Store
+
+	lock sync.RWMutex
+	pins map[string]Pin // keyed by tag key
+}
+
+// Load reads the pins in fname (if it isn't empty) and the pins made with the admin API from s.
+func Load(ctx context.Context, s store.Store, fname string) (*Set, error) {
+	set := &Set{
+		s:    s,
+		pins: map[string]Pin{},
+	}
+
+	obj, err := s.Get(ctx, storeKey, store.Range{})
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("can't load pins from store: %w", err)
+	default:
+		defer obj.Body.Close()
+
+		var pins []Pin
+		if err := json.NewDecoder(obj.Body).Decode(&pins); err != nil {
+			return nil, fmt.Errorf("can't parse pins from store: %w", err)
+		}
+
+		for _, p := range pins {
+			set.pins[p.Key()] = p
+		}
+	}
+
+	// Pins in the file win over pins made with the API, so that the file is the source of truth.
+	if fname != "" {
+		pins, err := readFile(fname)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range pins {
+			set.pins[p.Key()] = p
+		}
+	}
+
+	return set, nil
+}
+
+// readFile reads a pin file. Pin files have one pin per line. Blank lines and lines starting with
+// `#` are ignored.
+func readFile(fname string) ([]Pin, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("can't read pin file: %w", err)
+	}
+
+	var result []Pin
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		p, err := Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fname, line, err)
+		}
+		p.FromFile = true
+
+		result = append(result, p)
+	}
+
+	return result, nil
+}
+
+// Pinned returns the digest the tag at key is pinned to, if it is pinned.
+func (s *Set) Pinned(key string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	p, ok := s.pins[key]
+	return p.Digest, ok
+}
+
+// List returns every pin, sorted by name and tag.
+func (s *Set) List() []Pin {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := make([]Pin, 0, len(s.pins))
+	for _, p := range s.pins {
+		result = append(result, p)
+	}
+
+	slices.SortFunc(result, func(a, b Pin) int {
+		return strings.Compare(a.String(), b.String())
+	})
+
+	return result
+}
+
+// Digests returns the digest of every pinned manifest.
+func (s *Set) Digests() []string {
+	var result []string
+
+	for _, p := range s.List() {
+		result = append(result, p.Digest)
+	}
+
+	return result
+}
+
+// Add pins a tag, replacing any pin it already had unless that pin is in the pin file.
+func (s *Set) Add(ctx context.Context, p Pin) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old, ok := s.pins[p.Key()]; ok && old.FromFile {
+		return ErrFromFile
+	}
+
+	p.FromFile = false
+
+	pins := maps.Clone(s.pins)
+	pins[p.Key()] = p
+
+	return s.save(ctx, pins)
+}
+
+// Remove unpins a tag, unless it is pinned in the pin file.
+func (s *Set) Remove(ctx context.Context, name, tag string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, ok := s.pins[TagKey(name, tag)]
+	switch {
+	case !ok:
+		return ErrNotPinned
+	case old.FromFile:
+		return ErrFromFile
+	}
+
+	pins := maps.Clone(s.pins)
+	delete(pins, old.Key())
+
+	return s.save(ctx, pins)
+}
+
+// save writes the pins made with the API to the store, and only then makes pins the current set so
+// that a failed save doesn't change anything. s.lock must be held.
+func (s *Set) save(ctx context.Context, pins map[string]Pin) error {
+	saved := []Pin{}
+	for _, p := range pins {
+		if !p.FromFile {
+			saved = append(saved, p)
+		}
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("can't encode pins: %w", err)
+	}
+
+	if err := s.s.Put(ctx, storeKey, bytes.NewReader(data), int64(len(data)), store.PutOptions{
+		ContentType: "application/json",
+	}); err != nil {
+		return fmt.Errorf("can't save pins: %w", err)
+	}
+
+	s.pins = pins
+	return nil
+}
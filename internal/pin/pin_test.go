@@ -0,0 +1,132 @@
+package pin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+const testDigest = "sha256:4dc7aa34615388a266ce5e58cd0e7ad5a8a0af358d2d100b509f723305eb38bb"
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    Pin
+		wantErr bool
+	}{
+		{in: "library/llama3:8b@" + testDigest, want: Pin{Name: "library/llama3", Tag: "8b", Digest: testDigest}},
+		{in: "library/llama3@" + testDigest, want: Pin{Name: "library/llama3", Tag: "latest", Digest: testDigest}},
+		{in: "localhost:5000/team/model@" + testDigest, want: Pin{Name: "localhost:5000/team/model", Tag: "latest", Digest: testDigest}},
+		{in: "library/llama3:8b", wantErr: true},
+		{in: "library/llama3:8b@md5:abcd", wantErr: true},
+		{in: "@" + testDigest, wantErr: true},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wanted error: %v, got: %v", tt.wantErr, err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	ctx := context.Background()
+
+	fname := filepath.Join(t.TempDir(), "pins.txt")
+	if err := os.WriteFile(fname, []byte("# production models\nlibrary/llama3:8b@"+testDigest+"\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := store.NewMemory()
+
+	set, err := Load(ctx, s, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if digest, ok := set.Pinned("v2/library/llama3/manifests/8b"); !ok || digest != testDigest {
+		t.Fatalf("pin from file is missing, got %q, %v", digest, ok)
+	}
+
+	if err := set.Remove(ctx, "library/llama3", "8b"); !errors.Is(err, ErrFromFile) {
+		t.Fatalf("wanted ErrFromFile removing a pin from the file, got %v", err)
+	}
+
+	if err := set.Add(ctx, Pin{Name: "library/qwen2", Tag: "latest", Digest: testDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pins made with the API survive a restart.
+	set, err = Load(ctx, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := set.Pinned("v2/library/qwen2/manifests/latest"); !ok {
+		t.Fatal("pin made with the API was not saved")
+	}
+
+	if _, ok := set.Pinned("v2/library/llama3/manifests/8b"); ok {
+		t.Fatal("pin from the file was saved to the store")
+	}
+
+	if err := set.Remove(ctx, "library/qwen2", "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.Remove(ctx, "library/qwen2", "latest"); !errors.Is(err, ErrNotPinned) {
+		t.Fatalf("wanted ErrNotPinned, got %v", err)
+	}
+}
+
+// brokenStore is a store that can't be written to.
+type brokenStore struct {
+	store.Store
+}
+
+func (brokenStore) Put(ctx context.Context, key string, body io.Reader, size int64, opts store.PutOptions) error {
+	return errors.New("bucket is read-only")
+}
+
+func TestSetSaveFails(t *testing.T) {
+	ctx := context.Background()
+
+	s := store.NewMemory()
+
+	set, err := Load(ctx, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.Add(ctx, Pin{Name: "library/llama3", Tag: "8b", Digest: testDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	set.s = brokenStore{s}
+
+	if err := set.Add(ctx, Pin{Name: "library/qwen2", Tag: "latest", Digest: testDigest}); err == nil {
+		t.Fatal("adding a pin didn't fail")
+	}
+
+	if _, ok := set.Pinned("v2/library/qwen2/manifests/latest"); ok {
+		t.Fatal("pin that couldn't be saved was added")
+	}
+
+	if err := set.Remove(ctx, "library/llama3", "8b"); err == nil {
+		t.Fatal("removing a pin didn't fail")
+	}
+
+	if _, ok := set.Pinned("v2/library/llama3/manifests/8b"); !ok {
+		t.Fatal("pin was removed even though that couldn't be saved")
+	}
+}
@@ -0,0 +1,291 @@
+// Package registryauth implements the authentication flow that Docker-style registries use.
+//
+// Registries answer unauthenticated requests with `401 Unauthorized` and a `WWW-Authenticate`
+// challenge like `Bearer realm="https://auth.example.com/token",service="registry",scope="repository:library/llama3:pull"`.
+// The client is expected to get a token for that scope from the realm (using its credentials, if it
+// has any) and retry the request with it. Tokens are cached per registry and scope so that the dance
+// only happens once per repository until the token expires.
+package registryauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTokenLifetime is how long a token lasts if the token service doesn't say. This is the
+	// lifetime the distribution spec says clients should assume.
+	defaultTokenLifetime = 60 * time.Second
+
+	// expiryMargin is how long before a token expires that it stops being used.
+	expiryMargin = 10 * time.Second
+)
+
+// repositoryRegex matches the repository name in a registry URL.
+var repositoryRegex = regexp.MustCompile(`/v2/(.+?)/(?:manifests|blobs)/`)
+
+// Credentials are what a Transport uses to authenticate to a registry.
+type Credentials struct {
+	// Username and Password are sent to the token service (or to the registry, if it uses basic
+	// auth).
+	Username string
+	Password string
+
+	// Token is a static bearer token that is sent with every request instead of doing the token
+	// dance.
+	Token string
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+type registry struct {
+	baseURL string
+	creds   Credentials
+}
+
+// Transport is an http.RoundTripper that answers registry authentication challenges.
+//
+// Requests to registries registered with credentials always use those credentials, replacing any
+// Authorization header on the request. Other requests are sent as-is, and only go through the
+// token dance if they were sent without an Authorization header (such as for registries that hand
+// out anonymous tokens).
+type Transport struct {
+	base       http.RoundTripper
+	registries []registry
+
+	lock   sync.Mutex
+	tokens map[string]token // keyed by host and scope
+}
+
+// New creates a Transport that sends requests with base.
+func New(base http.RoundTripper) *Transport {
+	return &Transport{
+		base:   base,
+		tokens: map[string]token{},
+	}
+}
+
+// Register sets the credentials for every URL under baseURL. If more than one registered base URL
+// matches a request, the longest one wins.
+func (t *Transport) Register(baseURL string, creds Credentials) {
+	t.registries = append(t.registries, registry{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		creds:   creds,
+	})
+}
+
+func (t *Transport) credentialsFor(u *url.URL) (Credentials, bool) {
+	var (
+		result Credentials
+		best   = -1
+	)
+
+	s := u.String()
+	for _, r := range t.registries {
+		if (s == r.baseURL || strings.HasPrefix(s, r.baseURL+"/")) && len(r.baseURL) > best {
+			result, best = r.creds, len(r.baseURL)
+		}
+	}
+
+	return result, best != -1
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, registered := t.credentialsFor(req.URL)
+	if !registered && req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Del("Authorization")
+
+	if creds.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+creds.Token)
+		return t.base.RoundTrip(req)
+	}
+
+	scope := scopeFor(req.URL)
+	if tok, ok := t.cached(req.URL.Host, scope); ok {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Only requests without bodies can be retried.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	scheme, params := ParseChallenge(resp.Header.Get("WWW-Authenticate"))
+
+	var authorization string
+	switch scheme {
+	case "basic":
+		if creds.Username == "" {
+			return resp, nil
+		}
+		req.SetBasicAuth(creds.Username, creds.Password)
+		authorization = req.Header.Get("Authorization")
+	case "bearer":
+		tok, err := t.fetchToken(req, params, creds)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		t.store(req.URL.Host, scope, tok)
+		if params["scope"] != "" && params["scope"] != scope {
+			t.store(req.URL.Host, params["scope"], tok)
+		}
+		authorization = "Bearer " + tok.value
+	default:
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	if req.GetBody != nil {
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("Authorization", authorization)
+
+	return t.base.RoundTrip(req)
+}
+
+func (t *Transport) cached(host, scope string) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	tok, ok := t.tokens[host+" "+scope]
+	if !ok || time.Now().After(tok.expires) {
+		return "", false
+	}
+
+	return tok.value, true
+}
+
+func (t *Transport) store(host, scope string, tok token) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.tokens[host+" "+scope] = tok
+}
+
+// fetchToken gets a token from the realm in a bearer challenge.
+func (t *Transport) fetchToken(orig *http.Request, params map[string]string, creds Credentials) (token, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return token{}, fmt.Errorf("registryauth: bad realm in challenge: %q", params["realm"])
+	}
+
+	q := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			q.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(orig.Context(), http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return token{}, fmt.Errorf("registryauth: can't make token request: %w", err)
+	}
+
+	if creds.Username != "" {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return token{}, fmt.Errorf("registryauth: can't fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return token{}, fmt.Errorf("registryauth: can't fetch token from %s, wrong status: want %d, got %d", realm.Host, http.StatusOK, resp.StatusCode)
+	}
+
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return token{}, fmt.Errorf("registryauth: can't parse token response: %w", err)
+	}
+
+	value := tr.Token
+	if value == "" {
+		value = tr.AccessToken
+	}
+	if value == "" {
+		return token{}, fmt.Errorf("registryauth: token service at %s didn't return a token", realm.Host)
+	}
+
+	lifetime := defaultTokenLifetime
+	if tr.ExpiresIn > 0 {
+		lifetime = time.Duration(tr.ExpiresIn) * time.Second
+	}
+
+	return token{
+		value:   value,
+		expires: time.Now().Add(lifetime - expiryMargin),
+	}, nil
+}
+
+// scopeFor guesses the scope a request needs, so that cached tokens can be sent without waiting for
+// a challenge.
+func scopeFor(u *url.URL) string {
+	matches := repositoryRegex.FindStringSubmatch(u.Path)
+	if len(matches) != 2 {
+		return ""
+	}
+
+	return "repository:" + matches[1] + ":pull"
+}
+
+// ParseChallenge parses a WWW-Authenticate header into its (lowercased) scheme and parameters.
+func ParseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end == -1 {
+				value, after = after[1:], ""
+			} else {
+				value, after = after[1:end+1], after[end+2:]
+			}
+		} else {
+			value, after, _ = strings.Cut(after, ",")
+			after = "," + after
+		}
+
+		params[key] = strings.TrimSpace(value)
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(after), ","))
+	}
+
+	return strings.ToLower(scheme), params
+}
@@ -0,0 +1,105 @@
+package registryauth
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			header: `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:library/llama3:pull"`,
+			scheme: "bearer",
+			params: map[string]string{"realm": "https://auth.example.com/token", "service": "registry.example.com", "scope": "repository:library/llama3:pull"},
+		},
+		{
+			header: `Bearer realm="https://auth.example.com/token", scope="repository:a:pull,push"`,
+			scheme: "bearer",
+			params: map[string]string{"realm": "https://auth.example.com/token", "scope": "repository:a:pull,push"},
+		},
+		{
+			header: `Basic realm=registry`,
+			scheme: "basic",
+			params: map[string]string{"realm": "registry"},
+		},
+		{
+			header: "",
+			scheme: "",
+			params: map[string]string{},
+		},
+	} {
+		scheme, params := ParseChallenge(tt.header)
+		if scheme != tt.scheme || !maps.Equal(params, tt.params) {
+			t.Errorf("ParseChallenge(%q) = %q, %v; want %q, %v", tt.header, scheme, params, tt.scheme, tt.params)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var tokenRequests int
+
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+
+		if user, pass, ok := r.BasicAuth(); !ok || user != "yukari" || pass != "hunter2" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+
+		if got := r.URL.Query().Get("scope"); got != "repository:team/model:pull" {
+			http.Error(w, "bad scope "+got, http.StatusForbidden)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"token": "sekrit", "expires_in": 300})
+	}))
+	defer auth.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sekrit" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+auth.URL+`/token",service="registry",scope="repository:team/model:pull"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		io.WriteString(w, "i am a manifest")
+	}))
+	defer registry.Close()
+
+	tr := New(http.DefaultTransport)
+	tr.Register(registry.URL, Credentials{Username: "yukari", Password: "hunter2"})
+	cli := &http.Client{Transport: tr}
+
+	for range 2 {
+		req, err := http.NewRequest(http.MethodGet, registry.URL+"/v2/team/model/manifests/latest", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a client's credentials must not leak to a registry Yukari has its own credentials for
+		req.Header.Set("Authorization", "Bearer client-token")
+
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wanted status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+		}
+	}
+
+	if tokenRequests != 1 {
+		t.Fatalf("wanted the token to be fetched once and cached, got %d token requests", tokenRequests)
+	}
+}
@@ -0,0 +1,380 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// metaDir is the directory under the root of an FS store that holds object metadata.
+	metaDir = ".yukari-meta"
+
+	// uploadDir is the directory under the root of an FS store that holds in-progress multipart
+	// uploads.
+	uploadDir = ".yukari-uploads"
+)
+
+// FS is a Store that keeps objects as files on the local filesystem, for air-gapped and development
+// deployments. Object contents are stored at their key relative to the root directory, so the
+// directory tree mirrors the key layout used in buckets (`v2/...` and `blobs/sha256:...`).
+// Attributes such as the content type are stored in JSON files under a hidden metadata directory.
+type FS struct {
+	root string
+}
+
+type fsMeta struct {
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ETag               string            `json:"etag,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// NewFS creates a new filesystem store rooted at dir, creating it if it does not exist.
+func NewFS(dir string) (*FS, error) {
+	for _, sub := range []string{metaDir, uploadDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("store: can't create %s: %w", dir, err)
+		}
+	}
+
+	return &FS{root: dir}, nil
+}
+
+func (f *FS) path(key string) (string, error) {
+	fname := filepath.FromSlash(key)
+	if !filepath.IsLocal(fname) || strings.HasPrefix(fname, metaDir) || strings.HasPrefix(fname, uploadDir) {
+		return "", fmt.Errorf("store: invalid key %q", key)
+	}
+
+	return filepath.Join(f.root, fname), nil
+}
+
+func (f *FS) metaPath(key string) string {
+	return filepath.Join(f.root, metaDir, filepath.FromSlash(key)+".json")
+}
+
+func (f *FS) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	fname, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := os.Stat(fname)
+	if err != nil {
+		return nil, fsError(key, err)
+	}
+
+	if st.IsDir() {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	var meta fsMeta
+	data, err := os.ReadFile(f.metaPath(key))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("store: can't parse metadata for %s: %w", key, err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("store: can't read metadata for %s: %w", key, err)
+	}
+
+	return &ObjectInfo{
+		Key:                key,
+		Size:               st.Size(),
+		ContentType:        meta.ContentType,
+		ContentDisposition: meta.ContentDisposition,
+		ETag:               meta.ETag,
+		LastModified:       st.ModTime(),
+		Metadata:           meta.Metadata,
+	}, nil
+}
+
+// Put writes the object to a temporary file next to its final location and renames it into place
+// once all of body has been read, so partially written objects are never visible.
+func (f *FS) Put(ctx context.Context, key string, body io.Reader, size int64, opts PutOptions) error {
+	fname, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	h := md5.New()
+	if err := writeFileAtomic(fname, io.TeeReader(body, h), size); err != nil {
+		return fmt.Errorf("store: can't put %s: %w", key, err)
+	}
+
+	meta, err := json.Marshal(fsMeta{
+		ContentType:        opts.ContentType,
+		ContentDisposition: opts.ContentDisposition,
+		ETag:               `"` + hex.EncodeToString(h.Sum(nil)) + `"`,
+		Metadata:           opts.Metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("store: can't encode metadata for %s: %w", key, err)
+	}
+
+	if err := writeFileAtomic(f.metaPath(key), bytes.NewReader(meta), int64(len(meta))); err != nil {
+		return fmt.Errorf("store: can't put metadata for %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func writeFileAtomic(fname string, body io.Reader, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(fname), 0o755); err != nil {
+		return err
+	}
+
+	fout, err := os.CreateTemp(filepath.Dir(fname), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fout.Name())
+	defer fout.Close()
+
+	n, err := io.Copy(fout, body)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 && n != size {
+		return fmt.Errorf("wanted %d bytes, got %d", size, n)
+	}
+
+	if err := fout.Sync(); err != nil {
+		return err
+	}
+
+	if err := fout.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(fout.Name(), fname)
+}
+
+func (f *FS) Get(ctx context.Context, key string, rng Range) (*Object, error) {
+	info, err := f.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	fname, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fin, err := os.Open(fname)
+	if err != nil {
+		return nil, fsError(key, err)
+	}
+
+	if rng.Offset > info.Size {
+		fin.Close()
+		return nil, fmt.Errorf("store: range %s is out of bounds for %s", rng.header(), key)
+	}
+
+	if _, err := fin.Seek(rng.Offset, io.SeekStart); err != nil {
+		fin.Close()
+		return nil, fmt.Errorf("store: can't seek in %s: %w", key, err)
+	}
+
+	length := info.Size - rng.Offset
+	if rng.Length > 0 && rng.Length < length {
+		length = rng.Length
+	}
+	info.Size = length
+
+	return &Object{
+		ObjectInfo: *info,
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(fin, length), fin},
+	}, nil
+}
+
+func (f *FS) Presign(ctx context.Context, method, key string) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+func (f *FS) List(ctx context.Context, q Query) ([]ObjectInfo, error) {
+	var result []ObjectInfo
+
+	err := filepath.WalkDir(f.root, func(fname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if d.Name() == metaDir || d.Name() == uploadDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.root, fname)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, q.Prefix) {
+			return nil
+		}
+
+		info, err := f.Stat(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if q.matches(*info) {
+			result = append(result, *info)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store: can't list objects: %w", err)
+	}
+
+	return result, nil
+}
+
+func (f *FS) Delete(ctx context.Context, key string) error {
+	fname, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	for _, fname := range []string{fname, f.metaPath(key)} {
+		if err := os.Remove(fname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("store: can't delete %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// CreateMultipart starts a multipart upload. Parts are kept in their own directory until the upload
+// is completed or aborted.
+func (f *FS) CreateMultipart(ctx context.Context, key string, opts PutOptions) (string, error) {
+	if _, err := f.path(key); err != nil {
+		return "", err
+	}
+
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("store: can't make upload ID: %w", err)
+	}
+	uploadID := hex.EncodeToString(buf[:])
+
+	data, err := json.Marshal(fsUpload{Key: key, Options: opts})
+	if err != nil {
+		return "", fmt.Errorf("store: can't encode upload for %s: %w", key, err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(f.root, uploadDir, uploadID, "upload.json"), bytes.NewReader(data), int64(len(data))); err != nil {
+		return "", fmt.Errorf("store: can't start multipart upload for %s: %w", key, err)
+	}
+
+	return uploadID, nil
+}
+
+type fsUpload struct {
+	Key     string     `json:"key"`
+	Options PutOptions `json:"options"`
+}
+
+func (f *FS) upload(key, uploadID string) (string, *fsUpload, error) {
+	dir := filepath.Join(f.root, uploadDir, filepath.Base(uploadID))
+
+	data, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		return "", nil, fmt.Errorf("can't read upload %s: %w", uploadID, fsError(key, err))
+	}
+
+	var u fsUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return "", nil, fmt.Errorf("can't parse upload %s: %w", uploadID, err)
+	}
+
+	if u.Key != key {
+		return "", nil, fmt.Errorf("upload %s is for %s, not %s", uploadID, u.Key, key)
+	}
+
+	return dir, &u, nil
+}
+
+func (f *FS) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64) (*Part, error) {
+	dir, _, err := f.upload(key, uploadID)
+	if err != nil {
+		return nil, fmt.Errorf("store: can't upload part %d of %s: %w", number, key, err)
+	}
+
+	h := md5.New()
+	if err := writeFileAtomic(filepath.Join(dir, strconv.Itoa(int(number))), io.TeeReader(body, h), size); err != nil {
+		return nil, fmt.Errorf("store: can't upload part %d of %s: %w", number, key, err)
+	}
+
+	return &Part{
+		Number: number,
+		ETag:   `"` + hex.EncodeToString(h.Sum(nil)) + `"`,
+	}, nil
+}
+
+func (f *FS) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	dir, u, err := f.upload(key, uploadID)
+	if err != nil {
+		return fmt.Errorf("store: can't complete multipart upload for %s: %w", key, err)
+	}
+
+	var readers []io.Reader
+	for _, part := range parts {
+		fin, err := os.Open(filepath.Join(dir, strconv.Itoa(int(part.Number))))
+		if err != nil {
+			return fmt.Errorf("store: can't complete multipart upload for %s: %w", key, fsError(key, err))
+		}
+		defer fin.Close()
+
+		readers = append(readers, fin)
+	}
+
+	if err := f.Put(ctx, key, io.MultiReader(readers...), -1, u.Options); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func (f *FS) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	dir, _, err := f.upload(key, uploadID)
+	if err != nil {
+		return fmt.Errorf("store: can't abort multipart upload for %s: %w", key, err)
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func fsError(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	return fmt.Errorf("store: can't fetch %s: %w", key, err)
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Store that keeps everything in memory. It is intended for tests and development.
+type Memory struct {
+	objects map[string]memoryObject
+	lock    sync.RWMutex
+}
+
+type memoryObject struct {
+	info ObjectInfo
+	data []byte
+}
+
+// NewMemory creates a new empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		objects: map[string]memoryObject{},
+	}
+}
+
+func (m *Memory) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	info := obj.info
+	return &info, nil
+}
+
+func (m *Memory) Put(ctx context.Context, key string, body io.Reader, size int64, opts PutOptions) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("store: can't read body for %s: %w", key, err)
+	}
+
+	if size >= 0 && int64(len(data)) != size {
+		return fmt.Errorf("store: wanted %d bytes for %s, got %d", size, key, len(data))
+	}
+
+	sum := md5.Sum(data)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.objects[key] = memoryObject{
+		info: ObjectInfo{
+			Key:                key,
+			Size:               int64(len(data)),
+			ContentType:        opts.ContentType,
+			ContentDisposition: opts.ContentDisposition,
+			ETag:               `"` + hex.EncodeToString(sum[:]) + `"`,
+			LastModified:       time.Now(),
+			Metadata:           maps.Clone(opts.Metadata),
+		},
+		data: data,
+	}
+
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string, rng Range) (*Object, error) {
+	m.lock.RLock()
+	obj, ok := m.objects[key]
+	m.lock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	data := obj.data
+	if rng.Offset > int64(len(data)) {
+		return nil, fmt.Errorf("store: range %s is out of bounds for %s", rng.header(), key)
+	}
+	data = data[rng.Offset:]
+	if rng.Length > 0 && rng.Length < int64(len(data)) {
+		data = data[:rng.Length]
+	}
+
+	info := obj.info
+	info.Size = int64(len(data))
+
+	return &Object{
+		ObjectInfo: info,
+		Body:       io.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+func (m *Memory) Presign(ctx context.Context, method, key string) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+func (m *Memory) List(ctx context.Context, q Query) ([]ObjectInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var result []ObjectInfo
+
+	for key, obj := range m.objects {
+		if !strings.HasPrefix(key, q.Prefix) || !q.matches(obj.info) {
+			continue
+		}
+
+		result = append(result, obj.info)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+
+	return result, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.objects, key)
+
+	return nil
+}
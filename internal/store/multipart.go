@@ -0,0 +1,35 @@
+package store
+
+import (
+	"context"
+	"io"
+)
+
+// Part is a completed part of a multipart upload.
+type Part struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// Multipart is implemented by stores that can assemble an object out of separately uploaded parts.
+// Nothing is visible at the object's key until CompleteMultipart is called, and an upload can be
+// continued by another process as long as it knows the upload ID and the parts uploaded so far.
+type Multipart interface {
+	// CreateMultipart starts a new multipart upload and returns its ID.
+	CreateMultipart(ctx context.Context, key string, opts PutOptions) (string, error)
+
+	// UploadPart uploads size bytes of body as part number of an upload. Part numbers start at 1.
+	// Every part but the last must be at least 5 MiB.
+	UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64) (*Part, error)
+
+	// CompleteMultipart assembles the parts (in order) into the final object.
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error
+
+	// AbortMultipart throws away an upload and any parts uploaded for it.
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+}
+
+var (
+	_ Multipart = (*S3)(nil)
+	_ Multipart = (*FS)(nil)
+)
@@ -0,0 +1,426 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// maxPutSize is the largest object S3 will accept in a single PutObject call.
+	maxPutSize = 5 << 30
+
+	// partSize is the size of each part in a multipart upload. S3 allows at most 10,000 parts, so
+	// this caps objects at about 312 GiB.
+	partSize = 32 << 20
+)
+
+// S3 is a Store backed by any S3-compatible object storage system (AWS S3, MinIO, Ceph, etc).
+type S3 struct {
+	cli           *s3.Client
+	psc           *s3.PresignClient
+	bucket        string
+	publicBaseURL *url.URL
+}
+
+// PresignOptions control the presigned URLs handed out to clients. The zero value presigns URLs
+// against the client's endpoint with the SDK's default expiry.
+type PresignOptions struct {
+	// Endpoint is the S3 endpoint URLs are signed against, such as a custom domain for the bucket.
+	Endpoint string
+
+	// PublicBaseURL replaces the scheme and host of presigned URLs (and is prepended to their
+	// path), such as for a CDN in front of the bucket. The CDN has to pass requests through to the
+	// bucket unchanged for the signature to be valid.
+	PublicBaseURL string
+
+	// Expiry is how long presigned URLs are valid for.
+	Expiry time.Duration
+}
+
+// NewS3 creates a new S3 store that keeps objects in bucket.
+func NewS3(cli *s3.Client, bucket string, popts PresignOptions) (*S3, error) {
+	s := &S3{
+		cli:    cli,
+		bucket: bucket,
+	}
+
+	if popts.PublicBaseURL != "" {
+		u, err := url.Parse(popts.PublicBaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("store: can't parse public base URL: %w", err)
+		}
+
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("store: public base URL must be absolute, got %q", popts.PublicBaseURL)
+		}
+
+		s.publicBaseURL = u
+	}
+
+	s.psc = s3.NewPresignClient(cli, func(o *s3.PresignOptions) {
+		if popts.Expiry > 0 {
+			o.Expires = popts.Expiry
+		}
+
+		if popts.Endpoint != "" {
+			o.ClientOptions = append(o.ClientOptions, func(o *s3.Options) {
+				o.BaseEndpoint = aws.String(popts.Endpoint)
+			})
+		}
+	})
+
+	return s, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	resp, err := s.cli.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store: can't fetch %s: %w", key, s3Error(err))
+	}
+
+	return &ObjectInfo{
+		Key:                key,
+		Size:               aws.ToInt64(resp.ContentLength),
+		ContentType:        aws.ToString(resp.ContentType),
+		ContentDisposition: aws.ToString(resp.ContentDisposition),
+		ETag:               aws.ToString(resp.ETag),
+		LastModified:       aws.ToTime(resp.LastModified),
+		Metadata:           resp.Metadata,
+	}, nil
+}
+
+// Put uploads an object with a single PutObject call when possible. Objects of unknown size or that
+// are too big for PutObject are sent as a multipart upload instead.
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64, opts PutOptions) error {
+	if size < 0 || size > maxPutSize {
+		return s.putMultipart(ctx, key, body, opts)
+	}
+
+	inp := &s3.PutObjectInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		Body:     body,
+		Metadata: opts.Metadata,
+	}
+
+	if size >= 0 {
+		inp.ContentLength = &size
+	}
+
+	if opts.ContentType != "" {
+		inp.ContentType = &opts.ContentType
+	}
+
+	if opts.ContentDisposition != "" {
+		inp.ContentDisposition = &opts.ContentDisposition
+	}
+
+	if _, err := s.cli.PutObject(ctx, inp); err != nil {
+		return fmt.Errorf("store: can't put %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *S3) putMultipart(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	uploadID, err := s.CreateMultipart(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := s.uploadParts(ctx, key, uploadID, body); err != nil {
+		if abortErr := s.AbortMultipart(context.WithoutCancel(ctx), key, uploadID); abortErr != nil {
+			err = errors.Join(err, abortErr)
+		}
+
+		return fmt.Errorf("store: can't put %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *S3) uploadParts(ctx context.Context, key, uploadID string, body io.Reader) error {
+	var parts []Part
+	buf := make([]byte, partSize)
+
+	for partNumber := int32(1); ; partNumber++ {
+		n, readErr := io.ReadFull(body, buf)
+		if readErr == io.EOF && partNumber != 1 {
+			break
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+
+		// S3 requires at least one part, so an empty body is uploaded as one empty part.
+		part, err := s.UploadPart(ctx, key, uploadID, partNumber, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return err
+		}
+
+		parts = append(parts, *part)
+
+		if readErr != nil {
+			// A short read means that was the last part.
+			break
+		}
+	}
+
+	return s.CompleteMultipart(ctx, key, uploadID, parts)
+}
+
+func (s *S3) CreateMultipart(ctx context.Context, key string, opts PutOptions) (string, error) {
+	inp := &s3.CreateMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		Metadata: opts.Metadata,
+	}
+
+	if opts.ContentType != "" {
+		inp.ContentType = &opts.ContentType
+	}
+
+	if opts.ContentDisposition != "" {
+		inp.ContentDisposition = &opts.ContentDisposition
+	}
+
+	upload, err := s.cli.CreateMultipartUpload(ctx, inp)
+	if err != nil {
+		return "", fmt.Errorf("store: can't start multipart upload for %s: %w", key, err)
+	}
+
+	return aws.ToString(upload.UploadId), nil
+}
+
+func (s *S3) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64) (*Part, error) {
+	resp, err := s.cli.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        &s.bucket,
+		Key:           &key,
+		UploadId:      &uploadID,
+		PartNumber:    &number,
+		Body:          body,
+		ContentLength: &size,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store: can't upload part %d of %s: %w", number, key, s3Error(err))
+	}
+
+	return &Part{
+		Number: number,
+		ETag:   aws.ToString(resp.ETag),
+	}, nil
+}
+
+func (s *S3) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int32(part.Number),
+		})
+	}
+
+	if _, err := s.cli.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	}); err != nil {
+		return fmt.Errorf("store: can't complete multipart upload for %s: %w", key, s3Error(err))
+	}
+
+	return nil
+}
+
+func (s *S3) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	if _, err := s.cli.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	}); err != nil {
+		return fmt.Errorf("store: can't abort multipart upload for %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string, rng Range) (*Object, error) {
+	inp := &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}
+
+	if rng != (Range{}) {
+		inp.Range = aws.String(rng.header())
+	}
+
+	resp, err := s.cli.GetObject(ctx, inp)
+	if err != nil {
+		return nil, fmt.Errorf("store: can't fetch %s: %w", key, s3Error(err))
+	}
+
+	return &Object{
+		ObjectInfo: ObjectInfo{
+			Key:                key,
+			Size:               aws.ToInt64(resp.ContentLength),
+			ContentType:        aws.ToString(resp.ContentType),
+			ContentDisposition: aws.ToString(resp.ContentDisposition),
+			ETag:               aws.ToString(resp.ETag),
+			LastModified:       aws.ToTime(resp.LastModified),
+			Metadata:           resp.Metadata,
+		},
+		Body: resp.Body,
+	}, nil
+}
+
+func (s *S3) Presign(ctx context.Context, method, key string) (string, error) {
+	var (
+		req *v4.PresignedHTTPRequest
+		err error
+	)
+
+	switch method {
+	case http.MethodHead:
+		req, err = s.psc.PresignHeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &s.bucket,
+			Key:    &key,
+		})
+	case http.MethodGet:
+		req, err = s.psc.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: &s.bucket,
+			Key:    &key,
+		})
+	default:
+		return "", fmt.Errorf("store: can't presign method %s", method)
+	}
+	if err != nil {
+		return "", fmt.Errorf("store: can't presign %s %s: %w", method, key, err)
+	}
+
+	if s.publicBaseURL == nil {
+		return req.URL, nil
+	}
+
+	return rebaseURL(req.URL, s.publicBaseURL)
+}
+
+// rebaseURL moves a URL onto base, keeping its path (after base's path) and query.
+func rebaseURL(rawURL string, base *url.URL) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("store: can't parse presigned URL: %w", err)
+	}
+
+	result := base.JoinPath(u.EscapedPath())
+	result.RawQuery = u.RawQuery
+
+	return result.String(), nil
+}
+
+// List pages through every object under q.Prefix. Plain S3 has no way to filter on object metadata
+// server-side, so if q.ContentType is set every candidate object is HEADed to check it.
+func (s *S3) List(ctx context.Context, q Query) ([]ObjectInfo, error) {
+	objects, err := s.list(ctx, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ObjectInfo
+
+	for _, obj := range objects {
+		if q.ContentType != "" {
+			info, err := s.Stat(ctx, obj.Key)
+			if err != nil {
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				return nil, err
+			}
+			obj.ContentType = info.ContentType
+		}
+
+		if q.matches(obj) {
+			result = append(result, obj)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *S3) list(ctx context.Context, prefix string, optFns ...func(*s3.Options)) ([]ObjectInfo, error) {
+	inp := &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+	}
+
+	if prefix != "" {
+		inp.Prefix = &prefix
+	}
+
+	var result []ObjectInfo
+
+	pager := s3.NewListObjectsV2Paginator(s.cli, inp)
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx, optFns...)
+		if err != nil {
+			return nil, fmt.Errorf("store: can't list objects: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			result = append(result, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				ETag:         aws.ToString(obj.ETag),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return result, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if _, err := s.cli.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}); err != nil {
+		return fmt.Errorf("store: can't delete %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (r Range) header() string {
+	if r.Length <= 0 {
+		return fmt.Sprintf("bytes=%d-", r.Offset)
+	}
+
+	return fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1)
+}
+
+// s3Error converts "this object (or multipart upload) doesn't exist" errors from S3 into ErrNotFound.
+func s3Error(err error) error {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "NotFound", "NoSuchKey", "NoSuchUpload":
+			return ErrNotFound
+		}
+	}
+
+	return err
+}
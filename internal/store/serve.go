@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ServeMode is how cached objects are sent to clients.
+type ServeMode string
+
+const (
+	// ServeRedirect redirects clients to a presigned URL so that they download the object straight
+	// from the store. Stores that can't presign URLs fall back to ServeProxy.
+	ServeRedirect ServeMode = "redirect"
+
+	// ServeProxy streams the object through Yukari, for clients that can't reach the store.
+	ServeProxy ServeMode = "proxy"
+)
+
+// ParseServeMode parses a serve mode. The empty string means ServeRedirect.
+func ParseServeMode(s string) (ServeMode, error) {
+	switch mode := ServeMode(s); mode {
+	case "":
+		return ServeRedirect, nil
+	case ServeRedirect, ServeProxy:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("store: unknown serve mode %q, want %q or %q", s, ServeRedirect, ServeProxy)
+	}
+}
+
+// Serve sends an object to the client using mode. An error is only returned if a presigned URL
+// couldn't be made, in which case nothing has been written to w.
+func Serve(w http.ResponseWriter, r *http.Request, s Store, info *ObjectInfo, mode ServeMode) error {
+	if mode != ServeProxy {
+		presignedURL, err := s.Presign(r.Context(), r.Method, info.Key)
+		switch {
+		case err == nil:
+			http.Redirect(w, r, presignedURL, http.StatusTemporaryRedirect)
+			return nil
+		case !errors.Is(err, ErrPresignUnsupported):
+			return err
+		}
+	}
+
+	ServeContent(w, r, s, info)
+	return nil
+}
+
+// ServeContent streams an object to the client with http.ServeContent, so conditional requests,
+// HEAD, and Range requests are all handled. Callers may set additional response headers before
+// calling this.
+func ServeContent(w http.ResponseWriter, r *http.Request, s Store, info *ObjectInfo) {
+	ct := info.ContentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+
+	if info.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", info.ContentDisposition)
+	}
+
+	rs := NewReadSeeker(r.Context(), s, info)
+	defer rs.Close()
+
+	http.ServeContent(w, r, "", info.LastModified, rs)
+}
+
+// ReadSeeker adapts an object in a Store into an io.ReadSeekCloser. Seeking is free; the object is
+// only fetched (with a ranged Get starting at the current offset) when it is first read after a seek.
+type ReadSeeker struct {
+	ctx    context.Context
+	s      Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// NewReadSeeker creates a ReadSeeker for the object described by info.
+func NewReadSeeker(ctx context.Context, s Store, info *ObjectInfo) *ReadSeeker {
+	return &ReadSeeker{
+		ctx:  ctx,
+		s:    s,
+		key:  info.Key,
+		size: info.Size,
+	}
+}
+
+func (rs *ReadSeeker) Read(p []byte) (int, error) {
+	if rs.offset >= rs.size {
+		return 0, io.EOF
+	}
+
+	if rs.body == nil {
+		obj, err := rs.s.Get(rs.ctx, rs.key, Range{Offset: rs.offset})
+		if err != nil {
+			return 0, err
+		}
+		rs.body = obj.Body
+	}
+
+	n, err := rs.body.Read(p)
+	rs.offset += int64(n)
+	return n, err
+}
+
+func (rs *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = rs.offset + offset
+	case io.SeekEnd:
+		abs = rs.size + offset
+	default:
+		return 0, fmt.Errorf("store: invalid whence %d", whence)
+	}
+
+	if abs < 0 {
+		return 0, errors.New("store: negative position")
+	}
+
+	if abs != rs.offset && rs.body != nil {
+		rs.body.Close()
+		rs.body = nil
+	}
+
+	rs.offset = abs
+	return abs, nil
+}
+
+func (rs *ReadSeeker) Close() error {
+	if rs.body == nil {
+		return nil
+	}
+
+	err := rs.body.Close()
+	rs.body = nil
+	return err
+}
@@ -0,0 +1,95 @@
+// Package store abstracts the object storage that Yukari caches manifests, blobs, and metadata in.
+//
+// Every backend is bound to a single bucket (or root) and addresses objects by key using the same
+// layout the proxy has always used: tags live under their `v2/...` request path, manifests live under
+// `manifests/sha256:<digest>`, and blobs live under `blobs/sha256:<digest>`.
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the requested object does not exist.
+	ErrNotFound = errors.New("store: object not found")
+
+	// ErrPresignUnsupported is returned by backends that can't hand out presigned URLs. Callers should
+	// stream the object themselves instead.
+	ErrPresignUnsupported = errors.New("store: presigned URLs are not supported by this backend")
+)
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key                string
+	Size               int64
+	ContentType        string
+	ContentDisposition string
+	ETag               string
+	LastModified       time.Time
+	Metadata           map[string]string
+}
+
+// Object is an object's information and a reader for its contents. Callers must close Body.
+type Object struct {
+	ObjectInfo
+	Body io.ReadCloser
+}
+
+// PutOptions are the optional attributes stored alongside an object.
+type PutOptions struct {
+	ContentType        string
+	ContentDisposition string
+	Metadata           map[string]string
+}
+
+// Range selects part of an object. Length <= 0 means "until the end of the object", so the zero
+// value selects the entire object.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Query filters the objects returned by List. Zero-valued fields are not used for filtering.
+type Query struct {
+	Prefix         string
+	ContentType    string
+	ModifiedBefore time.Time
+}
+
+// Store is a place that Yukari can keep cached objects in.
+type Store interface {
+	// Stat returns information about an object, or ErrNotFound.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// Put stores the contents of body at key. size is the number of bytes in body, or -1 if it is
+	// not known ahead of time.
+	Put(ctx context.Context, key string, body io.Reader, size int64, opts PutOptions) error
+
+	// Get opens an object (or part of one) for reading, or returns ErrNotFound.
+	Get(ctx context.Context, key string, rng Range) (*Object, error)
+
+	// Presign returns a URL that clients can use to fetch the object with the given HTTP method
+	// without going through Yukari, or ErrPresignUnsupported.
+	Presign(ctx context.Context, method, key string) (string, error)
+
+	// List returns every object matching the query.
+	List(ctx context.Context, q Query) ([]ObjectInfo, error)
+
+	// Delete removes an object. Deleting an object that does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+func (q Query) matches(info ObjectInfo) bool {
+	if q.ContentType != "" && info.ContentType != q.ContentType {
+		return false
+	}
+
+	if !q.ModifiedBefore.IsZero() && !info.LastModified.Before(q.ModifiedBefore) {
+		return false
+	}
+
+	return true
+}
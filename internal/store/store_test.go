@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestFS(t *testing.T) {
+	s, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("can't make fs store: %v", err)
+	}
+
+	if err := s.Put(context.Background(), "../escape", strings.NewReader(""), 0, PutOptions{}); err == nil {
+		t.Fatal("fs store allowed a key outside of its root")
+	}
+
+	testStore(t, s)
+}
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := s.Stat(ctx, "blobs/sha256:foo"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("wanted ErrNotFound for missing object, got: %v", err)
+	}
+
+	if err := s.Put(ctx, "blobs/sha256:foo", strings.NewReader("hello, world"), 12, PutOptions{ContentType: "text/plain"}); err != nil {
+		t.Fatalf("can't put object: %v", err)
+	}
+
+	if err := s.Put(ctx, "v2/library/llama3/manifests/latest", strings.NewReader("{}"), -1, PutOptions{ContentType: "application/json"}); err != nil {
+		t.Fatalf("can't put object of unknown size: %v", err)
+	}
+
+	info, err := s.Stat(ctx, "blobs/sha256:foo")
+	if err != nil {
+		t.Fatalf("can't stat object: %v", err)
+	}
+
+	if info.Size != 12 || info.ContentType != "text/plain" {
+		t.Fatalf("wrong object info: %+v", info)
+	}
+
+	for _, cs := range []struct {
+		name string
+		rng  Range
+		want string
+	}{
+		{"whole", Range{}, "hello, world"},
+		{"offset", Range{Offset: 7}, "world"},
+		{"offsetLength", Range{Offset: 2, Length: 3}, "llo"},
+	} {
+		t.Run(cs.name, func(t *testing.T) {
+			obj, err := s.Get(ctx, "blobs/sha256:foo", cs.rng)
+			if err != nil {
+				t.Fatalf("can't get object: %v", err)
+			}
+			defer obj.Body.Close()
+
+			data, err := io.ReadAll(obj.Body)
+			if err != nil {
+				t.Fatalf("can't read object: %v", err)
+			}
+
+			if string(data) != cs.want {
+				t.Fatalf("wanted %q, got %q", cs.want, string(data))
+			}
+		})
+	}
+
+	objects, err := s.List(ctx, Query{Prefix: "v2/", ContentType: "application/json", ModifiedBefore: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("can't list objects: %v", err)
+	}
+
+	if len(objects) != 1 || objects[0].Key != "v2/library/llama3/manifests/latest" {
+		t.Fatalf("wrong list result: %+v", objects)
+	}
+
+	if err := s.Delete(ctx, "blobs/sha256:foo"); err != nil {
+		t.Fatalf("can't delete object: %v", err)
+	}
+
+	if _, err := s.Stat(ctx, "blobs/sha256:foo"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("wanted ErrNotFound for deleted object, got: %v", err)
+	}
+}
+
+func TestS3Presign(t *testing.T) {
+	cli := s3.New(s3.Options{
+		Region:       "auto",
+		BaseEndpoint: aws.String("https://s3.internal.invalid"),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	})
+
+	for _, tt := range []struct {
+		name       string
+		opts       PresignOptions
+		wantPrefix string
+		wantExpiry string
+	}{
+		{
+			name:       "default",
+			wantPrefix: "https://s3.internal.invalid/models/blobs/sha256%3Aabc?",
+			wantExpiry: "900",
+		},
+		{
+			name:       "custom endpoint",
+			opts:       PresignOptions{Endpoint: "https://models.example.com", Expiry: time.Hour},
+			wantPrefix: "https://models.example.com/models/blobs/sha256%3Aabc?",
+			wantExpiry: "3600",
+		},
+		{
+			name:       "public base URL",
+			opts:       PresignOptions{PublicBaseURL: "https://cdn.example.com/yukari"},
+			wantPrefix: "https://cdn.example.com/yukari/models/blobs/sha256%3Aabc?",
+			wantExpiry: "900",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewS3(cli, "models", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.Presign(context.Background(), http.MethodGet, "blobs/sha256:abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(got, tt.wantPrefix) {
+				t.Fatalf("wrong presigned URL: got %s, want it to start with %s", got, tt.wantPrefix)
+			}
+
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expiry := u.Query().Get("X-Amz-Expires"); expiry != tt.wantExpiry {
+				t.Fatalf("wrong expiry: got %s, want %s", expiry, tt.wantExpiry)
+			}
+		})
+	}
+}
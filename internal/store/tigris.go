@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tigrisdata-community/yukari/tigris"
+)
+
+// Tigris is an S3 store that uses Tigris' metadata querying[1] to filter List results server-side.
+//
+// [1]: https://www.tigrisdata.com/docs/objects/query-metadata/
+type Tigris struct {
+	*S3
+}
+
+// NewTigris creates a new Tigris store that keeps objects in bucket.
+func NewTigris(cli *s3.Client, bucket string, popts PresignOptions) (*Tigris, error) {
+	s, err := NewS3(cli, bucket, popts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tigris{s}, nil
+}
+
+func (t *Tigris) List(ctx context.Context, q Query) ([]ObjectInfo, error) {
+	var clauses []string
+
+	if q.ContentType != "" {
+		clauses = append(clauses, fmt.Sprintf("`Content-Type` = %q", q.ContentType))
+	}
+
+	if !q.ModifiedBefore.IsZero() {
+		clauses = append(clauses, fmt.Sprintf("`Last-Modified` < %q", q.ModifiedBefore.Format(time.RFC3339)))
+	}
+
+	var optFns []func(*s3.Options)
+	if len(clauses) != 0 {
+		optFns = append(optFns, tigris.WithQuery(strings.Join(clauses, " AND ")))
+	}
+
+	objects, err := t.list(ctx, q.Prefix, optFns...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range objects {
+		objects[i].ContentType = q.ContentType
+	}
+
+	return objects, nil
+}
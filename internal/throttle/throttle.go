@@ -0,0 +1,160 @@
+// Package throttle limits how much bandwidth background cache fills can use, so they don't saturate
+// the uplink that clients are also pulling through.
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the smallest burst given to a limiter, so that slow limits don't turn every read into
+// a tiny one.
+const minBurst = 32 << 10
+
+// Throttle limits the rate of reads across every reader it wraps. Each reader is limited by the
+// global limit and the limit for its upstream host, if there is one. The zero value and a nil
+// *Throttle don't limit anything.
+type Throttle struct {
+	global *rate.Limiter
+	hosts  map[string]*rate.Limiter
+	window Window
+}
+
+// New creates a Throttle that limits reads to global bytes per second in total and to hosts[host]
+// bytes per second per upstream host. Zero means unlimited. Limits only apply while window is
+// active.
+func New(global int64, hosts map[string]int, window Window) *Throttle {
+	t := &Throttle{
+		global: newLimiter(global),
+		hosts:  map[string]*rate.Limiter{},
+		window: window,
+	}
+
+	for host, limit := range hosts {
+		t.hosts[host] = newLimiter(int64(limit))
+	}
+
+	return t
+}
+
+func newLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), max(int(bytesPerSecond), minBurst))
+}
+
+// Reader wraps r so that reading from it counts against the limits for host. Waiting for the
+// limiter stops when ctx is done.
+func (t *Throttle) Reader(ctx context.Context, host string, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+
+	var limiters []*rate.Limiter
+	for _, l := range []*rate.Limiter{t.global, t.hosts[host]} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+
+	if len(limiters) == 0 {
+		return r
+	}
+
+	return &reader{ctx: ctx, r: r, t: t, limiters: limiters}
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	t        *Throttle
+	limiters []*rate.Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if !r.t.window.Contains(time.Now()) {
+		return r.r.Read(p)
+	}
+
+	for _, l := range r.limiters {
+		if len(p) > l.Burst() {
+			p = p[:l.Burst()]
+		}
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if waitErr := l.WaitN(r.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+
+	return n, err
+}
+
+// Window is the time of day that limits apply in, such as working hours. The zero value means all
+// day. Windows that end before they start wrap around midnight.
+type Window struct {
+	Start, End time.Duration // since local midnight
+}
+
+// ParseWindow parses a window in the form `08:00-18:00`. An empty string means all day.
+func ParseWindow(s string) (Window, error) {
+	if s == "" {
+		return Window{}, nil
+	}
+
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("can't parse window %q: want HH:MM-HH:MM", s)
+	}
+
+	var (
+		w   Window
+		err error
+	)
+
+	if w.Start, err = parseClock(start); err != nil {
+		return Window{}, err
+	}
+
+	if w.End, err = parseClock(end); err != nil {
+		return Window{}, err
+	}
+
+	return w, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("can't parse time of day %q: %w", s, err)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns true if t is inside the window.
+func (w Window) Contains(t time.Time) bool {
+	if w == (Window{}) {
+		return true
+	}
+
+	y, m, d := t.Date()
+	offset := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+
+	return offset >= w.Start || offset < w.End
+}
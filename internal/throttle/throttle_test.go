@@ -0,0 +1,90 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, time.December, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	for _, tt := range []struct {
+		window string
+		at     time.Time
+		want   bool
+	}{
+		{window: "", at: at(3, 0), want: true},
+		{window: "08:00-18:00", at: at(8, 0), want: true},
+		{window: "08:00-18:00", at: at(17, 59), want: true},
+		{window: "08:00-18:00", at: at(18, 0), want: false},
+		{window: "08:00-18:00", at: at(3, 0), want: false},
+		{window: "22:00-06:00", at: at(23, 30), want: true},
+		{window: "22:00-06:00", at: at(5, 0), want: true},
+		{window: "22:00-06:00", at: at(12, 0), want: false},
+	} {
+		w, err := ParseWindow(tt.window)
+		if err != nil {
+			t.Fatalf("can't parse %q: %v", tt.window, err)
+		}
+
+		if got := w.Contains(tt.at); got != tt.want {
+			t.Errorf("%q contains %s: got %v, want %v", tt.window, tt.at.Format("15:04"), got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"8am-6pm", "08:00", "25:00-26:00"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("parsed bad window %q", bad)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	const limit = minBurst // bytes per second, and the burst
+
+	th := New(0, map[string]int{"slow.example": limit}, Window{})
+
+	for _, tt := range []struct {
+		host string
+		min  time.Duration
+		max  time.Duration
+	}{
+		// the first burst is free, and the next half a second's worth has to wait for the limiter
+		{host: "slow.example", min: 400 * time.Millisecond, max: 5 * time.Second},
+		{host: "fast.example", max: 100 * time.Millisecond},
+	} {
+		start := time.Now()
+
+		n, err := io.Copy(io.Discard, th.Reader(context.Background(), tt.host, bytes.NewReader(make([]byte, limit+limit/2))))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != limit+limit/2 {
+			t.Fatalf("%s: read %d bytes, want %d", tt.host, n, limit+limit/2)
+		}
+
+		if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("%s: reading took %s, want between %s and %s", tt.host, elapsed, tt.min, tt.max)
+		}
+	}
+}
+
+func TestReaderOutsideWindow(t *testing.T) {
+	// a window that is never active
+	th := New(minBurst, nil, Window{Start: time.Hour, End: time.Hour})
+
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, th.Reader(context.Background(), "", bytes.NewReader(make([]byte, 4*minBurst)))); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("reading outside of the window was throttled, took %s", elapsed)
+	}
+}
@@ -0,0 +1,189 @@
+// Package upstream maps the repositories clients pull from Yukari to the upstream registries they
+// are mirrored from.
+//
+// Each route owns a path prefix under `/v2/`. A request for `/v2/hf.co/bartowski/model/manifests/latest`
+// is sent to the route with the prefix `hf.co` as `/v2/bartowski/model/manifests/latest`. Manifests are
+// cached under the path the client asked for, so routes never overwrite each other's manifests, while
+// blobs are content-addressed and shared between every route.
+package upstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/tigrisdata-community/yukari/internal/registryauth"
+	"github.com/tigrisdata-community/yukari/internal/store"
+)
+
+// Route sends requests for repositories under Prefix to the registry at URL.
+type Route struct {
+	// Prefix is the part of the repository name that selects this route, such as `hf.co`. The
+	// empty prefix is the default route, used for everything no other route matches.
+	Prefix string `json:"prefix"`
+	URL    string `json:"url"`
+
+	// Credentials for the upstream registry. If any are set, they are used instead of the
+	// Authorization header sent by the client. A username and password are used to get tokens
+	// from the registry's token service, while a token is sent as-is.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+
+	// Serve is how cached objects from this upstream are sent to clients. If empty, the default
+	// passed to Load is used.
+	Serve store.ServeMode `json:"serve,omitempty"`
+
+	u *url.URL
+}
+
+// Name returns a human readable name for the route.
+func (r *Route) Name() string {
+	if r.Prefix == "" {
+		return "default"
+	}
+
+	return r.Prefix
+}
+
+// HasCredentials returns true if the route has its own credentials for the upstream registry.
+func (r *Route) HasCredentials() bool {
+	return r.Username != "" || r.Token != ""
+}
+
+// Table is a set of routes.
+type Table struct {
+	routes    []*Route // longest prefix first
+	transport *registryauth.Transport
+}
+
+// New makes a routing table out of routes.
+func New(routes []Route) (*Table, error) {
+	t := &Table{transport: registryauth.New(http.DefaultTransport)}
+	seen := map[string]bool{}
+
+	for _, r := range routes {
+		r.Prefix = strings.Trim(r.Prefix, "/")
+		if seen[r.Prefix] {
+			return nil, fmt.Errorf("upstream: more than one route for prefix %q", r.Prefix)
+		}
+		seen[r.Prefix] = true
+
+		serve, err := store.ParseServeMode(string(r.Serve))
+		if err != nil {
+			return nil, fmt.Errorf("upstream: route %s: %w", r.Name(), err)
+		}
+		r.Serve = serve
+
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream: can't parse URL for route %s: %w", r.Name(), err)
+		}
+
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("upstream: URL for route %s must be absolute, got %q", r.Name(), r.URL)
+		}
+
+		r.u = u
+		t.routes = append(t.routes, &r)
+
+		if r.HasCredentials() {
+			t.transport.Register(u.String(), registryauth.Credentials{
+				Username: r.Username,
+				Password: r.Password,
+				Token:    r.Token,
+			})
+		}
+	}
+
+	slices.SortFunc(t.routes, func(a, b *Route) int {
+		return len(b.Prefix) - len(a.Prefix)
+	})
+
+	return t, nil
+}
+
+// Load reads a JSON array of routes from fname, expanding environment variables in credentials so
+// that they can be kept out of the file. If the file doesn't have a default route, one is added
+// for defaultURL. If fname is empty, the table only has the default route. Routes that don't say
+// how to serve cached objects use defaultServe.
+func Load(fname, defaultURL string, defaultServe store.ServeMode) (*Table, error) {
+	var routes []Route
+
+	if fname != "" {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			return nil, fmt.Errorf("upstream: can't read routes: %w", err)
+		}
+
+		if err := json.Unmarshal(data, &routes); err != nil {
+			return nil, fmt.Errorf("upstream: can't parse routes in %s: %w", fname, err)
+		}
+
+		for i := range routes {
+			if routes[i].Serve == "" {
+				routes[i].Serve = defaultServe
+			}
+			routes[i].Username = os.ExpandEnv(routes[i].Username)
+			routes[i].Password = os.ExpandEnv(routes[i].Password)
+			routes[i].Token = os.ExpandEnv(routes[i].Token)
+		}
+	}
+
+	if !slices.ContainsFunc(routes, func(r Route) bool { return strings.Trim(r.Prefix, "/") == "" }) {
+		routes = append(routes, Route{URL: defaultURL, Serve: defaultServe})
+	}
+
+	return New(routes)
+}
+
+// Transport returns an http.RoundTripper that authenticates to every upstream with its route's
+// credentials, handling registry token challenges.
+func (t *Table) Transport() http.RoundTripper {
+	return t.transport
+}
+
+// Client returns an HTTP client that uses Transport.
+func (t *Table) Client() *http.Client {
+	return &http.Client{Transport: t.transport}
+}
+
+// ErrNoRoute is returned when no route matches a path.
+var ErrNoRoute = errors.New("upstream: no route for repository")
+
+// Resolve finds the route for a registry path (such as `/v2/hf.co/org/model/manifests/latest`) or
+// cache key (such as `v2/hf.co/org/model/manifests/latest`) and returns the URL to fetch it from
+// upstream.
+func (t *Table) Resolve(p string) (*Route, *url.URL, error) {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(p, "/"), "v2")
+	if !ok || (rest != "" && rest[0] != '/') {
+		return nil, nil, fmt.Errorf("%w: %s is not a registry path", ErrNoRoute, p)
+	}
+	rest = strings.TrimPrefix(rest, "/")
+
+	for _, r := range t.routes {
+		upstreamPath, ok := rest, r.Prefix == ""
+		if !ok {
+			upstreamPath, ok = strings.CutPrefix(rest, r.Prefix+"/")
+		}
+
+		if ok {
+			u := r.u.JoinPath("v2", upstreamPath)
+			if !strings.HasPrefix(u.Path, "/") {
+				// JoinPath doesn't add a leading slash to URLs without a path, like `https://hf.co`.
+				u.Path = "/" + u.Path
+			}
+			if strings.HasSuffix(p, "/") && !strings.HasSuffix(u.Path, "/") {
+				u.Path += "/"
+			}
+			return r, u, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%w: %s", ErrNoRoute, p)
+}
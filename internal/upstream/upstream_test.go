@@ -0,0 +1,63 @@
+package upstream
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	table, err := New([]Route{
+		{URL: "https://registry.ollama.ai/"},
+		{Prefix: "hf.co", URL: "https://hf.co"},
+		{Prefix: "internal", URL: "https://registry.example.com/ollama/", Token: "hunter2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path  string
+		route string
+		url   string
+	}{
+		{path: "/v2/library/llama3/manifests/latest", route: "default", url: "https://registry.ollama.ai/v2/library/llama3/manifests/latest"},
+		{path: "v2/library/llama3/manifests/latest", route: "default", url: "https://registry.ollama.ai/v2/library/llama3/manifests/latest"},
+		{path: "/v2/hf.co/bartowski/Llama-3.2-1B-Instruct-GGUF/manifests/latest", route: "hf.co", url: "https://hf.co/v2/bartowski/Llama-3.2-1B-Instruct-GGUF/manifests/latest"},
+		{path: "/v2/internal/team/model/blobs/sha256:abc", route: "internal", url: "https://registry.example.com/ollama/v2/team/model/blobs/sha256:abc"},
+		{path: "/v2/internalish/model/manifests/latest", route: "default", url: "https://registry.ollama.ai/v2/internalish/model/manifests/latest"},
+		{path: "/v2/", route: "default", url: "https://registry.ollama.ai/v2/"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			route, u, err := table.Resolve(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if route.Name() != tt.route {
+				t.Errorf("wrong route: got %s, want %s", route.Name(), tt.route)
+			}
+
+			if u.String() != tt.url {
+				t.Errorf("wrong URL: got %s, want %s", u, tt.url)
+			}
+
+			if !strings.HasPrefix(u.Path, "/") {
+				t.Errorf("URL path %q is not absolute", u.Path)
+			}
+		})
+	}
+
+	if _, _, err := table.Resolve("/civitai/download/1"); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("wanted ErrNoRoute for a non-registry path, got %v", err)
+	}
+}
+
+func TestNewRejectsDuplicatePrefixes(t *testing.T) {
+	if _, err := New([]Route{
+		{Prefix: "hf.co", URL: "https://hf.co"},
+		{Prefix: "/hf.co/", URL: "https://hf.co"},
+	}); err == nil {
+		t.Fatal("duplicate prefixes were accepted")
+	}
+}
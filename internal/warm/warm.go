@@ -0,0 +1,340 @@
+// Package warm prefetches models into the cache, so that they can be pulled quickly (or at all)
+// later without anyone having to pull them first.
+package warm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/civitai"
+	"github.com/tigrisdata-community/yukari/internal/civitaiproxy"
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/modelref"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+	"github.com/tigrisdata-community/yukari/internal/upstream"
+)
+
+// pollInterval is how often the store is checked to see if warming is done.
+const pollInterval = 2 * time.Second
+
+// ErrBusy is returned when models are already being warmed.
+var ErrBusy = errors.New("warm: already warming models")
+
+// State is how far along warming a model is.
+type State string
+
+const (
+	StatePending State = "pending"
+	StateCached  State = "cached"
+	StateFailed  State = "failed"
+)
+
+// Report is the progress of warming a set of models.
+type Report struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"` // unset while warming
+	Models   []Model   `json:"models"`
+}
+
+// Done returns true if every model is cached or failed.
+func (r *Report) Done() bool {
+	return !r.Finished.IsZero()
+}
+
+// Model is the progress of warming one model.
+type Model struct {
+	Ref     string `json:"ref"`
+	State   State  `json:"state"`
+	Error   string `json:"error,omitempty"`
+	Objects int    `json:"objects"` // manifests and blobs, once they are known
+	Missing int    `json:"missing"`
+}
+
+// Warmer drives a Downloader to cache models.
+type Warmer struct {
+	s      store.Store
+	d      *download.Downloader
+	routes *upstream.Table
+	pins   *pin.Set
+	civ    *civitai.Client
+
+	lock sync.Mutex
+	last *Report
+}
+
+// New creates a Warmer. civ is nil if Civitai is disabled.
+func New(s store.Store, d *download.Downloader, routes *upstream.Table, pins *pin.Set, civ *civitai.Client) *Warmer {
+	return &Warmer{
+		s:      s,
+		d:      d,
+		routes: routes,
+		pins:   pins,
+		civ:    civ,
+	}
+}
+
+// Status returns the progress of the last warming, or nil if nothing has been warmed.
+func (w *Warmer) Status() *Report {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.last == nil {
+		return nil
+	}
+
+	r := *w.last
+	r.Models = append([]Model(nil), w.last.Models...)
+	return &r
+}
+
+// job is a model being warmed.
+type job struct {
+	modelref.Ref
+
+	keys        []string // that have to be cached
+	manifestKey string   // Ollama models only
+	manifestURL string
+	blobsQueued bool
+}
+
+// Start queues the downloads for every target, returning a channel that gets the report once all
+// of them are cached or have failed, or ctx is done. Only one set of models can be warmed at a time.
+func (w *Warmer) Start(ctx context.Context, targets []modelref.Ref) (<-chan *Report, error) {
+	r := &Report{Started: time.Now()}
+	for _, t := range targets {
+		r.Models = append(r.Models, Model{Ref: t.Raw, State: StatePending})
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.last != nil && !w.last.Done() {
+		return nil, ErrBusy
+	}
+	w.last = &Report{Started: r.Started, Models: append([]Model(nil), r.Models...)}
+
+	result := make(chan *Report, 1)
+	go func() {
+		result <- w.run(ctx, r, targets)
+	}()
+
+	return result, nil
+}
+
+func (w *Warmer) run(ctx context.Context, r *Report, targets []modelref.Ref) *Report {
+	// If ctx is done first, warming is marked as finished anyway so that it can be started again.
+	defer func() {
+		if !r.Done() {
+			r.Finished = time.Now()
+			w.update(r)
+		}
+	}()
+
+	jobs := make([]*job, len(targets))
+
+	for i, t := range targets {
+		j, err := w.queue(ctx, t)
+		if err != nil {
+			slog.Error("can't warm model", "ref", t.Raw, "err", err)
+			r.Models[i].State = StateFailed
+			r.Models[i].Error = err.Error()
+			continue
+		}
+		jobs[i] = j
+	}
+
+	w.update(r)
+
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+
+	for {
+		done := w.poll(ctx, r, jobs)
+		if done {
+			r.Finished = time.Now()
+		}
+		w.update(r)
+
+		if done {
+			return w.Status()
+		}
+
+		select {
+		case <-ctx.Done():
+			return w.Status()
+		case <-t.C:
+		}
+	}
+}
+
+func (w *Warmer) update(r *Report) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	cp := *r
+	cp.Models = append([]Model(nil), r.Models...)
+	w.last = &cp
+}
+
+// queue starts downloading a target.
+func (w *Warmer) queue(ctx context.Context, t modelref.Ref) (*job, error) {
+	if t.IsCivitai() {
+		return w.queueCivitai(ctx, t)
+	}
+
+	key := t.Key()
+
+	_, u, err := w.routes.Resolve(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pinned tags are warmed at their pinned digest, like they are served.
+	if digest, ok := w.pins.Pinned(key); ok {
+		key = download.ManifestKey(digest)
+		u.Path = path.Join(path.Dir(u.Path), digest)
+		u.RawPath = ""
+	}
+
+	j := &job{
+		Ref:         t,
+		keys:        []string{key},
+		manifestKey: key,
+		manifestURL: u.String(),
+	}
+
+	w.d.Fetch(download.Request{
+		Key:     key,
+		PullURL: j.manifestURL,
+	})
+
+	return j, nil
+}
+
+func (w *Warmer) queueCivitai(ctx context.Context, t modelref.Ref) (*job, error) {
+	if w.civ == nil {
+		return nil, errors.New("civitai is not enabled, set CIVITAI_TOKEN")
+	}
+
+	mv, err := w.civ.FetchModelVersion(ctx, t.ModelVersion)
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch model version info: %w", err)
+	}
+
+	// The model's metadata is cached too so that the invalidator and garbage collector know about it.
+	model, err := w.civ.FetchModel(ctx, strconv.Itoa(mv.ModelID))
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch model info: %w", err)
+	}
+
+	if err := civitaiproxy.PutModelMetadata(ctx, w.s, model); err != nil {
+		return nil, err
+	}
+
+	j := &job{Ref: t}
+
+	for _, file := range mv.Files {
+		req := civitaiproxy.DownloadRequest(w.civ, mv.ID, file)
+		j.keys = append(j.keys, req.Key)
+		w.d.Fetch(req)
+	}
+
+	return j, nil
+}
+
+// poll updates the report with how far along each job is, returning true if they are all done.
+func (w *Warmer) poll(ctx context.Context, r *Report, jobs []*job) bool {
+	active := map[string]bool{}
+	for _, st := range w.d.Active() {
+		active[st.Key] = true
+	}
+
+	// Dead letters left over from before warming started don't count while their key is being
+	// downloaded again.
+	failed := map[string]string{}
+
+	deadLetters, err := w.d.DeadLetters(ctx)
+	if err != nil {
+		slog.Error("can't list dead letters", "err", err)
+	}
+	for _, st := range deadLetters {
+		if st.UpdatedAt.After(r.Started) || !active[st.Key] {
+			failed[st.Key] = st.Error
+		}
+	}
+
+	done := true
+
+	for i, j := range jobs {
+		m := &r.Models[i]
+		if j == nil || m.State != StatePending {
+			continue
+		}
+
+		if err := w.pollJob(ctx, j, m, failed); err != nil {
+			slog.Error("can't check if model is warm", "ref", j.Raw, "err", err)
+		}
+
+		if m.State == StatePending {
+			done = false
+		}
+	}
+
+	return done
+}
+
+func (w *Warmer) pollJob(ctx context.Context, j *job, m *Model, failed map[string]string) error {
+	// Blobs are only known once the manifest is cached.
+	if j.manifestKey != "" && !j.blobsQueued {
+		if _, err := w.s.Stat(ctx, j.manifestKey); err == nil {
+			mf, err := download.LoadManifest(ctx, w.s, j.manifestKey)
+			if err != nil {
+				return err
+			}
+
+			for _, blob := range mf.Blobs() {
+				j.keys = append(j.keys, download.BlobKey(blob.Digest))
+			}
+
+			// The downloader queues the blobs of manifests it downloads, but not of ones that were
+			// already cached.
+			w.d.FetchBlobs(*mf, j.manifestURL, "")
+			j.blobsQueued = true
+		}
+	}
+
+	m.Objects = len(j.keys)
+	m.Missing = 0
+
+	for _, key := range j.keys {
+		_, err := w.s.Stat(ctx, key)
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+
+		if msg, ok := failed[key]; ok {
+			m.State = StateFailed
+			m.Error = fmt.Sprintf("%s: %s", key, msg)
+			return nil
+		}
+
+		m.Missing++
+	}
+
+	if m.Missing == 0 && (j.manifestKey == "" || j.blobsQueued) {
+		m.State = StateCached
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package warm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/modelref"
+	"github.com/tigrisdata-community/yukari/internal/store"
+	"github.com/tigrisdata-community/yukari/internal/upstream"
+)
+
+func TestWarm(t *testing.T) {
+	layer := "i am a model layer"
+	digest := download.Digest([]byte(layer))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[{"digest":%q,"size":%d}]}`, digest, len(layer))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/library/llama3/manifests/8b", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		io.WriteString(w, manifest)
+	})
+	mux.HandleFunc("/v2/library/llama3/blobs/"+digest, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, layer)
+	})
+
+	origin := httptest.NewServer(mux)
+	defer origin.Close()
+
+	routes, err := upstream.New([]upstream.Route{{URL: origin.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := modelref.ParseAll([]string{"library/llama3:8b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name        string
+		deadLetters []string // keys that failed before warming started
+	}{
+		{name: "cold"},
+		{name: "old dead letters", deadLetters: []string{targets[0].Key(), download.BlobKey(digest)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			s := store.NewMemory()
+			for i, key := range tt.deadLetters {
+				job := fmt.Sprintf(`{"id":"old-%d","key":%q,"state":"failed","attempts":5,"error":"upstream was down","updatedAt":%q}`, i, key, time.Now().Add(-time.Hour).Format(time.RFC3339))
+				if err := s.Put(ctx, fmt.Sprintf("yukari/jobs/old-%d", i), strings.NewReader(job), -1, store.PutOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d := download.New(s, download.Options{})
+			go d.Work(ctx)
+
+			w := New(s, d, routes, nil, nil)
+
+			result, err := w.Start(ctx, targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := w.Start(ctx, targets); err != ErrBusy {
+				t.Fatalf("wanted ErrBusy warming twice at once, got %v", err)
+			}
+
+			r := <-result
+			if !r.Done() {
+				t.Fatal("warming didn't finish")
+			}
+
+			if m := r.Models[0]; m.State != StateCached || m.Objects != 2 || m.Missing != 0 {
+				t.Fatalf("model wasn't warmed: %+v", m)
+			}
+
+			if _, err := s.Stat(ctx, download.BlobKey(digest)); err != nil {
+				t.Fatalf("layer wasn't cached: %v", err)
+			}
+		})
+	}
+}
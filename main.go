@@ -7,30 +7,73 @@ import (
 	"log"
 	"log/slog"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"os"
+	"os/signal"
 	"time"
 
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/facebookgo/flagenv"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/tigrisdata-community/yukari/civitai"
 	"github.com/tigrisdata-community/yukari/internal"
+	"github.com/tigrisdata-community/yukari/internal/admin"
+	"github.com/tigrisdata-community/yukari/internal/bundle"
 	"github.com/tigrisdata-community/yukari/internal/civitaiinvalidator"
 	"github.com/tigrisdata-community/yukari/internal/civitaiproxy"
 	"github.com/tigrisdata-community/yukari/internal/download"
+	"github.com/tigrisdata-community/yukari/internal/gc"
+	"github.com/tigrisdata-community/yukari/internal/modelref"
 	"github.com/tigrisdata-community/yukari/internal/ollamainvalidator"
 	"github.com/tigrisdata-community/yukari/internal/ollamaproxy"
+	"github.com/tigrisdata-community/yukari/internal/pin"
+	"github.com/tigrisdata-community/yukari/internal/store"
+	"github.com/tigrisdata-community/yukari/internal/throttle"
+	"github.com/tigrisdata-community/yukari/internal/upstream"
+	"github.com/tigrisdata-community/yukari/internal/warm"
 	"github.com/tigrisdata-community/yukari/tigris"
 )
 
 var (
+	adminBind         = flag.String("admin-bind", "127.0.0.1:9201", "host:port to serve the admin API on, empty to disable it. It isn't authenticated, so only bind it to addresses clients can't reach")
 	bind              = flag.String("bind", ":9200", "host:port to bind on")
 	civitaiToken      = flag.String("civitai-token", "", "Civitai API token")
+	downloadChunkSize = flag.Int64("download-chunk-size", download.DefaultChunkSize, "size in bytes of each ranged request when downloading big objects, at least 5 MiB")
+	downloadAttempts  = flag.Int("download-max-attempts", download.DefaultRetryPolicy.MaxAttempts, "how many times to try a background download before giving up on it")
+	downloadBaseDelay = flag.Duration("download-retry-base-delay", download.DefaultRetryPolicy.BaseDelay, "how long to wait before retrying a failed background download, doubled for every retry")
+	downloadMaxDelay  = flag.Duration("download-retry-max-delay", download.DefaultRetryPolicy.MaxDelay, "the longest time to wait before retrying a failed background download")
+	downloadHosts     = flag.String("download-host-limits", "", "comma-separated host=n pairs capping how many background downloads can run against each upstream host at once")
+	downloadRate      = flag.Int64("download-rate-limit", 0, "bytes per second that all background downloads can use together, 0 for unlimited")
+	downloadHostRates = flag.String("download-host-rate-limits", "", "comma-separated host=bytes-per-second pairs limiting background downloads from each upstream host")
+	downloadRateHours = flag.String("download-rate-limit-hours", "", "time of day that download rate limits apply in, such as 08:00-18:00, empty for all day")
+	downloadRanged    = flag.Int64("download-ranged-threshold", download.DefaultRangedThreshold, "objects bigger than this many bytes are downloaded in resumable ranged chunks")
+	downloadWorkers   = flag.Int("download-workers", 2, "how many background downloads to run at once")
+	gcBudget          = flag.Int64("gc-budget", 0, "if set, evict the least recently used models when storage is bigger than this many bytes")
+	gcDryRun          = flag.Bool("gc-dry-run", false, "if set, log and report which models the garbage collector would evict without deleting anything")
+	gcPeriod          = flag.Duration("gc-period", time.Hour, "how often to check storage against the garbage collection budget")
 	invalidatorPeriod = flag.Duration("invalidator-period", 30*time.Minute, "how often to check for invalid manifests")
 	manifestLifetime  = flag.Duration("manifest-lifetime", 240*time.Hour, "how long to keep cached manifests before invalidating them")
+	offline           = flag.Bool("offline", false, "if set, never contact upstream: serve only what is in storage, and turn off downloads, invalidators, and revalidation")
+	serveMode         = flag.String("serve-mode", "redirect", "how to send cached objects to clients: redirect to a presigned URL, or proxy them through Yukari")
+	pinFile           = flag.String("pin-file", "", "file of model:tag@digest pins, one per line, for tags that are never refreshed or evicted")
+	presignEndpoint   = flag.String("presign-endpoint", "", "if set, sign presigned URLs against this S3 endpoint instead of the one used for storage")
+	presignExpiry     = flag.Duration("presign-expiry", 15*time.Minute, "how long presigned URLs are valid for")
+	publicBaseURL     = flag.String("public-base-url", "", "if set, rewrite presigned URLs to start with this URL, such as a CDN in front of the bucket")
+	revalidate        = flag.Bool("revalidate-manifests", false, "if set, check cached manifests against upstream before serving them, so moved tags are never served stale")
+	revalidateTTL     = flag.Duration("revalidate-ttl", 30*time.Second, "how long to trust upstream's digest for a manifest when revalidating")
+	revalidateNegTTL  = flag.Duration("revalidate-negative-ttl", 10*time.Second, "how long to skip revalidating a manifest after upstream couldn't be reached")
+	s3PathStyle       = flag.Bool("s3-path-style", false, "if set, use path-style addressing for the s3 storage backend (needed for MinIO and most Ceph deployments)")
 	slogLevel         = flag.String("slog-level", "ERROR", "log level")
-	tigrisBucket      = flag.String("tigris-bucket", "yukari", "tigris bucket to store blobs and manifests in")
+	storageBackend    = flag.String("storage-backend", "tigris", "where to store blobs and manifests (tigris, s3, fs)")
+	streamThrough     = flag.Bool("stream-through", false, "if set, serve cache misses for blobs by saving them to storage while sending them to the client, instead of downloading them twice")
+	streamThroughDir  = flag.String("stream-through-dir", "", "directory to spool blobs being streamed through in, which needs room for every blob being streamed at once, empty for the system temporary directory")
+	storageDir        = flag.String("storage-dir", "./var", "directory to store blobs and manifests in when using the fs storage backend")
+	sweepDelete       = flag.Bool("sweep-delete", false, "if set, delete orphaned blobs older than the grace period instead of only reporting them")
+	sweepGrace        = flag.Duration("sweep-grace", 24*time.Hour, "how old an orphaned blob has to be before it is deleted")
+	sweepPeriod       = flag.Duration("sweep-period", 0, "how often to look for blobs that nothing refers to, 0 to disable")
+	tigrisBucket      = flag.String("tigris-bucket", "yukari", "bucket to store blobs and manifests in")
 	upstreamRegistry  = flag.String("upstream-registry", "https://registry.ollama.ai/", "upstream registry URL")
+	upstreamsFile     = flag.String("upstreams-file", "", "JSON file of extra upstream registries to route repository prefixes to, see README")
 )
 
 func main() {
@@ -42,43 +85,146 @@ func main() {
 
 	internal.InitSlog(*slogLevel)
 
-	upstream, err := url.Parse(*upstreamRegistry)
+	mode, err := store.ParseServeMode(*serveMode)
 	if err != nil {
-		log.Fatalf("can't parse upstream registry URL %q: %v", *upstreamRegistry, err)
+		log.Fatal(err)
 	}
 
-	singleHostReverseProxy := httputil.NewSingleHostReverseProxy(upstream)
+	routes, err := upstream.Load(*upstreamsFile, *upstreamRegistry, mode)
+	if err != nil {
+		log.Fatalf("can't load upstream registries: %v", err)
+	}
+
+	s, err := newStore(ctx)
+	if err != nil {
+		log.Fatalf("can't make %s store: %v", *storageBackend, err)
+	}
+
+	pins, err := pin.Load(ctx, s, *pinFile)
+	if err != nil {
+		log.Fatalf("can't load pins: %v", err)
+	}
+
+	switch flag.Arg(0) {
+	case "export":
+		os.Exit(runExport(ctx, s, flag.Args()[1:]))
+	case "import":
+		os.Exit(runImport(ctx, s, pins, flag.Args()[1:]))
+	}
 
-	s3c, err := tigris.Client(ctx)
+	hostLimits, err := download.ParseHostLimits(*downloadHosts)
 	if err != nil {
-		log.Fatalf("can't make Tigris client: %v", err)
+		log.Fatalf("can't parse download host limits: %v", err)
+	}
+
+	hostRates, err := download.ParseHostLimits(*downloadHostRates)
+	if err != nil {
+		log.Fatalf("can't parse download host rate limits: %v", err)
+	}
+
+	rateWindow, err := throttle.ParseWindow(*downloadRateHours)
+	if err != nil {
+		log.Fatalf("can't parse download rate limit hours: %v", err)
+	}
+
+	var civ *civitai.Client
+	if *civitaiToken != "" {
+		civ = civitai.New(*civitaiToken)
+	}
+
+	d := download.New(s, download.Options{
+		Client: routes.Client(),
+		Retry: download.RetryPolicy{
+			MaxAttempts: *downloadAttempts,
+			BaseDelay:   *downloadBaseDelay,
+			MaxDelay:    *downloadMaxDelay,
+		},
+		RangedThreshold: *downloadRanged,
+		ChunkSize:       *downloadChunkSize,
+		HostLimits:      hostLimits,
+		Throttle:        throttle.New(*downloadRate, hostRates, rateWindow),
+		Pins:            pins,
+		SpoolDir:        *streamThroughDir,
+		Authorize:       civitaiproxy.Authorize(civ),
+	})
+	// Offline, queued downloads are left in storage until Yukari is started online again.
+	if !*offline {
+		if err := d.Resume(ctx); err != nil {
+			slog.Error("can't resume download jobs", "err", err)
+		}
+		for range *downloadWorkers {
+			go d.Work(context.Background())
+		}
+	}
+
+	var warmer *warm.Warmer
+	if !*offline {
+		warmer = warm.New(s, d, routes, pins, civ)
+	}
+
+	if flag.Arg(0) == "warm" {
+		if *offline {
+			fmt.Fprintln(os.Stderr, "can't warm models while offline")
+			os.Exit(2)
+		}
+
+		os.Exit(runWarm(ctx, warmer, flag.Args()[1:]))
+	}
+
+	if *offline {
+		slog.Info("offline, only serving models in storage")
+	} else {
+		invalWorker := ollamainvalidator.New(s, d, routes, pins)
+		go invalWorker.Work(ctx, *invalidatorPeriod, *manifestLifetime)
 	}
 
-	d := download.New(s3c)
-	go d.Work(context.Background())
-	go d.Work(context.Background())
+	var (
+		access    *gc.Tracker
+		collector *gc.Collector
+	)
+	if *gcBudget > 0 {
+		access, err = gc.NewTracker(ctx, s)
+		if err != nil {
+			log.Fatalf("can't load access log: %v", err)
+		}
+		go access.Work(ctx)
 
-	invalWorker := ollamainvalidator.New(s3c, d, *tigrisBucket)
-	go invalWorker.Work(ctx, *invalidatorPeriod, *manifestLifetime)
+		collector = gc.New(s, access, pins, *gcBudget, *gcDryRun)
+		go collector.Work(ctx, *gcPeriod)
+	}
+
+	sweeper := gc.NewSweeper(s, access, pins, *sweepGrace)
+	if *sweepPeriod > 0 {
+		go sweeper.Work(ctx, *sweepPeriod, *sweepDelete)
+	}
+
+	var rv *ollamaproxy.Revalidator
+	if *revalidate && !*offline {
+		rv = ollamaproxy.NewRevalidator(routes.Client(), *revalidateTTL, *revalidateNegTTL)
+	}
 
 	mux := http.NewServeMux()
 
 	mux.Handle("/v2/", ollamaproxy.Handler(
-		singleHostReverseProxy,
+		routes,
 		d,
-		*tigrisBucket,
-		*upstream,
-		s3c,
+		s,
+		*streamThrough,
+		*offline,
+		rv,
+		pins,
+		access,
 	))
 
-	if *civitaiToken != "" {
+	// Offline, models can be served from storage without a Civitai token.
+	if civ != nil || *offline {
 		slog.Info("enabling civitai proxy")
 
-		civ := civitai.New(*civitaiToken)
-
-		civProxy := civitaiproxy.New(d, civ, s3c, *tigrisBucket)
-		civInvalWorker := civitaiinvalidator.New(s3c, d, civ, *tigrisBucket)
-		go civInvalWorker.Work(ctx, *invalidatorPeriod, *manifestLifetime)
+		civProxy := civitaiproxy.New(d, civ, s, mode, access, *offline)
+		if !*offline {
+			civInvalWorker := civitaiinvalidator.New(s, d, civ)
+			go civInvalWorker.Work(ctx, *invalidatorPeriod, *manifestLifetime)
+		}
 
 		mux.HandleFunc("/civitai/download/{modelVersion}", civProxy.ModelVersion)
 	}
@@ -87,6 +233,189 @@ func main() {
 		fmt.Fprintln(w, "OK")
 	})
 
+	if *adminBind != "" {
+		adminMux := http.NewServeMux()
+		admin.New(d, s, pins, collector, sweeper, warmer).Register(adminMux)
+
+		go func() {
+			slog.Info("starting admin server on", "url", "http://"+*adminBind)
+			log.Fatalf("can't start admin HTTP server: %v", http.ListenAndServe(*adminBind, adminMux))
+		}()
+	}
+
 	slog.Info("starting server on", "url", "http://0.0.0.0"+*bind)
 	log.Fatalf("can't start HTTP server: %v", http.ListenAndServe(*bind, mux))
 }
+
+func newStore(ctx context.Context) (store.Store, error) {
+	switch *storageBackend {
+	case "tigris":
+		s3c, err := tigris.Client(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return store.NewTigris(s3c, *tigrisBucket, presignOptions())
+	case "s3":
+		cfg, err := awsConfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load S3 config: %w", err)
+		}
+
+		s3c := s3.NewFromConfig(cfg, func(o *s3.Options) {
+			o.UsePathStyle = *s3PathStyle
+		})
+
+		return store.NewS3(s3c, *tigrisBucket, presignOptions())
+	case "fs":
+		return store.NewFS(*storageDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", *storageBackend)
+	}
+}
+
+// runWarm implements `yukari warm [model ...]`: it caches every model given on the command line and
+// returns the exit code.
+func runWarm(ctx context.Context, w *warm.Warmer, refs []string) int {
+	if len(refs) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: yukari [flags] warm <model:tag | civitai-model-version-id | air> ...")
+		return 2
+	}
+
+	targets, err := modelref.ParseAll(refs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	result, err := w.Start(ctx, targets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+
+	var r *warm.Report
+	for r == nil {
+		select {
+		case r = <-result:
+		case <-t.C:
+			var cached int
+			for _, m := range w.Status().Models {
+				if m.State == warm.StateCached {
+					cached++
+				}
+			}
+			fmt.Printf("%d/%d models cached\n", cached, len(targets))
+		}
+	}
+
+	code := 0
+	for _, m := range r.Models {
+		switch m.State {
+		case warm.StateFailed:
+			fmt.Printf("%s: failed: %s\n", m.Ref, m.Error)
+			code = 1
+		case warm.StatePending:
+			fmt.Printf("%s: interrupted with %d of %d objects left\n", m.Ref, m.Missing, m.Objects)
+			code = 1
+		default:
+			fmt.Printf("%s: cached (%d objects)\n", m.Ref, m.Objects)
+		}
+	}
+
+	return code
+}
+
+// runExport implements `yukari export [-o file] [model ...]`: it writes every model given on the
+// command line to a bundle and returns the exit code.
+func runExport(ctx context.Context, s store.Store, args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "-", "file to write the bundle to, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: yukari [flags] export [-o bundle.tar] <model:tag | civitai-model-version-id | air> ...")
+		return 2
+	}
+
+	refs, err := modelref.ParseAll(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	w := os.Stdout
+	if *output != "-" {
+		w, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	if err := bundle.Export(ctx, s, w, refs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if w != os.Stdout {
+			w.Close()
+			os.Remove(*output)
+		}
+		return 1
+	}
+
+	if err := w.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// runImport implements `yukari import <file>`: it loads a bundle into the store and returns the
+// exit code.
+func runImport(ctx context.Context, s store.Store, pins *pin.Set, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: yukari [flags] import <bundle.tar | ->")
+		return 2
+	}
+
+	r := os.Stdin
+	if args[0] != "-" {
+		fin, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer fin.Close()
+
+		r = fin
+	}
+
+	report, err := bundle.Import(ctx, s, pins, r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, m := range report.Models {
+		fmt.Printf("%s: imported\n", m)
+	}
+	fmt.Printf("%d blobs (%d bytes) stored, %d already cached\n", report.Blobs, report.Bytes, report.Skipped)
+
+	return 0
+}
+
+func presignOptions() store.PresignOptions {
+	return store.PresignOptions{
+		Endpoint:      *presignEndpoint,
+		PublicBaseURL: *publicBaseURL,
+		Expiry:        *presignExpiry,
+	}
+}